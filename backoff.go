@@ -0,0 +1,57 @@
+package rtm2_sdk
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultBackoffInitial    = time.Millisecond * 100
+	defaultBackoffMax        = time.Second * 5
+	defaultBackoffMultiplier = 2.0
+	defaultBackoffJitter     = 0.2
+	defaultBackoffRetries    = 10
+)
+
+// backoff computes exponential retry delays with a random jitter.
+// retries is the number of consecutive failed attempts allowed before giving up, zero or less means unlimited.
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+	retries    int
+}
+
+func defaultBackoff() backoff {
+	return backoff{
+		initial:    defaultBackoffInitial,
+		max:        defaultBackoffMax,
+		multiplier: defaultBackoffMultiplier,
+		jitter:     defaultBackoffJitter,
+		retries:    defaultBackoffRetries,
+	}
+}
+
+// delay returns the time to wait before the given attempt, attempt starts from 1.
+func (b backoff) delay(attempt int) time.Duration {
+	d := float64(b.initial)
+	for i := 1; i < attempt && d < float64(b.max); i++ {
+		d *= b.multiplier
+	}
+	if d > float64(b.max) {
+		d = float64(b.max)
+	}
+	if b.jitter > 0 {
+		d += d * b.jitter * (rand.Float64()*2 - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// exhausted reports whether the given attempt is beyond the retry budget.
+func (b backoff) exhausted(attempt int) bool {
+	return b.retries > 0 && attempt > b.retries
+}
@@ -0,0 +1,63 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"github.com/tomasliu-agora/rtm2"
+)
+
+// RTM2Client is the rtm2.RTMClient returned by CreateRTM2Client, extended with SDK specific features.
+type RTM2Client interface {
+	rtm2.RTMClient
+
+	// Stats returns a snapshot of the connection and sidecar counters.
+	Stats() Stats
+
+	// Call sends a request of rtm2-base, such as *base.PresenceWhoNowReq, and returns its decoded reply.
+	// Unlike the rtm2.RTMClient methods, which are bound to the client context, it gives up as soon as
+	// ctx is done; the timeout of the uri still applies to each attempt. The request bypasses the
+	// bookkeeping of rtm2-base, so it is meant for reads and for operations without local state.
+	Call(ctx context.Context, req Message) (interface{}, int32, error)
+
+	// Invoke sends payload to uri as is and returns the body of the reply with its error code, error replies
+	// included, for the operations of the sidecar the SDK has no request type for yet.
+	Invoke(ctx context.Context, uri int32, payload []byte) ([]byte, int32, error)
+	// SubscribeRaw hands the events the sidecar pushes on uri to handler undecoded, for the uris IsEvent
+	// does not know. It fails for a uri registered already.
+	SubscribeRaw(uri int32, handler RawEventHandler) error
+	// UnsubscribeRaw removes the handler of uri.
+	UnsubscribeRaw(uri int32)
+}
+
+type rtm2Client struct {
+	rtm2.RTMClient
+	invoker *rtmInvoker
+}
+
+func (c *rtm2Client) Stats() Stats {
+	var stats Stats
+	if c.invoker.conn != nil {
+		stats.Connection = c.invoker.conn.Stats()
+	}
+	if c.invoker.sidecar != nil {
+		stats.Sidecar = c.invoker.sidecar.Stats()
+	} else if c.invoker.shared != nil && c.invoker.shared.sidecar != nil {
+		stats.Sidecar = c.invoker.shared.sidecar.Stats()
+	}
+	return stats
+}
+
+func (c *rtm2Client) Call(ctx context.Context, req Message) (interface{}, int32, error) {
+	return c.invoker.OnReceivedContext(ctx, req)
+}
+
+func (c *rtm2Client) Invoke(ctx context.Context, uri int32, payload []byte) ([]byte, int32, error) {
+	return c.invoker.Invoke(ctx, uri, payload)
+}
+
+func (c *rtm2Client) SubscribeRaw(uri int32, handler RawEventHandler) error {
+	return c.invoker.SubscribeRaw(uri, handler)
+}
+
+func (c *rtm2Client) UnsubscribeRaw(uri int32) {
+	c.invoker.UnsubscribeRaw(uri)
+}
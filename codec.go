@@ -1,9 +1,46 @@
 package rtm2_sdk
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Wire format between the SDK and the sidecar.
+//
+// Lengths are written as a flex length, little endian:
+//   - values below 0x8000 take 2 bytes, the high bit of the second byte is clear.
+//   - values from 0x8000 to 0x3FFFFF take 3 bytes: the first two carry the low 15 bits with the
+//     high bit set, the third one carries bits 15 to 21 and its own high bit is clear.
+//
+// The decoder this SDK shipped with reads all 8 bits of the third byte, which would reach 0x7FFFFF,
+// but the sidecar's decoder is not part of this repository and the format is specified for lengths up
+// to about 4 MiB. A sidecar reading the third byte as 7 bits, like the second one, would misparse any
+// longer frame, so the high bit of the third byte is never written and frames above 0x3FFFFF are
+// refused both ways. A 3 bytes encoding of a value below 0x8000 is never produced and rejected as well.
+// Golden vectors:
+//
+//	0x0000   -> 00 00
+//	0x0001   -> 01 00
+//	0x7FFF   -> FF 7F
+//	0x8000   -> 00 80 01
+//	0x8001   -> 01 80 01
+//	0x12345  -> 45 A3 02
+//	0x3FFFFF -> FF FF 7F
+//
+// A frame is len(flex) + service_id(2) + uri(2) + content_length(flex) + content, where len counts
+// the whole frame including itself and content is a marshaled Header.
+// So the largest frame is 0x3FFFFF bytes, a bit less than 4 MiB.
 
 const byteThreshold = 0x8000
 
+// maxFrameSize is the largest value a 3 bytes flex length carries with the high bit of its third byte clear.
+const maxFrameSize = 0x7FFF + 0x7F<<15
+
+// ErrLengthOverflow is returned when a value cannot be represented as a flex length.
+var ErrLengthOverflow = errors.New("length cannot be represented as a flex length")
+
+// DecodeInt reads a flex length and returns its size along with the value.
+// buff must hold 2 bytes, 3 when the high bit of the second one is set.
 func DecodeInt(buff []byte) (int, int) {
 	low := binary.LittleEndian.Uint16(buff[0:2])
 	if low < byteThreshold {
@@ -13,6 +50,8 @@ func DecodeInt(buff []byte) (int, int) {
 	return 3, int(uint32(low)&0x7FFF + high<<15)
 }
 
+// TotalWithLength returns the length of content of the given size once prefixed by its own flex length,
+// along with the size of that prefix.
 func TotalWithLength(size int) (int, int) {
 	lenSize := 4
 	length := size + lenSize
@@ -26,23 +65,103 @@ func TotalWithLength(size int) (int, int) {
 	return length, lenSize
 }
 
-func EncodeInt(val int, buff []byte) {
+// EncodeInt writes val as a flex length, buff must hold 2 bytes, 3 when val >= 0x8000.
+func EncodeInt(val int, buff []byte) error {
+	if val < 0 || val > maxFrameSize {
+		return ErrLengthOverflow
+	}
 	if val >= byteThreshold {
 		binary.LittleEndian.PutUint16(buff[0:2], uint16(val&0x7FFF|0x8000))
 		buff[2] = uint8(val >> 15)
 	} else {
 		binary.LittleEndian.PutUint16(buff[0:2], uint16(val&0x7FFF))
 	}
+	return nil
 }
 
-func EncodeLen(content []byte, buffer []byte) []byte {
+// EncodeLen prefixes content with its flex length, reusing buffer when it is large enough.
+func EncodeLen(content []byte, buffer []byte) ([]byte, error) {
 	length, lenSize := TotalWithLength(len(content))
+	if length > maxFrameSize {
+		return nil, ErrLengthOverflow
+	}
 	if cap(buffer) < length {
 		buffer = make([]byte, length)
 	} else {
 		buffer = buffer[:length]
 	}
-	EncodeInt(length, buffer[:lenSize])
+	if err := EncodeInt(length, buffer[:lenSize]); err != nil {
+		return nil, err
+	}
 	copy(buffer[lenSize:], content)
-	return buffer
+	return buffer, nil
+}
+
+func contentLenSize(size int) int {
+	if size >= byteThreshold {
+		return 3
+	}
+	return 2
+}
+
+// FrameSize returns the total size of a frame carrying a header of headerSize bytes.
+// It may exceed the largest frame, EncodeFrame rejects those.
+func FrameSize(headerSize int) int {
+	length, _ := TotalWithLength(2 + 2 + contentLenSize(headerSize) + headerSize)
+	return length
+}
+
+// EncodeFrame writes h into buffer in place, buffer must hold FrameSize(headerSize) bytes.
+// A frame is len(flex) + service_id + uri + content_length(flex) + header.
+func EncodeFrame(buffer []byte, serviceId uint16, uri uint16, h *Header, headerSize int) error {
+	cLenS := contentLenSize(headerSize)
+	length, lenSize := TotalWithLength(2 + 2 + cLenS + headerSize)
+	if length > maxFrameSize {
+		return ErrLengthOverflow
+	}
+	_ = EncodeInt(length, buffer[:lenSize])
+	body := buffer[lenSize:length]
+	binary.LittleEndian.PutUint16(body[0:2], serviceId)
+	binary.LittleEndian.PutUint16(body[2:4], uri)
+	_ = EncodeInt(headerSize, body[4:4+cLenS])
+	_, err := h.MarshalToSizedBuffer(body[4+cLenS:])
+	return err
+}
+
+// DecodeFrameLen reads the length prefix of the frame at the head of buff.
+// The length includes the prefix itself, zero means buff is too short to tell yet.
+func DecodeFrameLen(buff []byte) (int, int, error) {
+	if len(buff) < 2 || (len(buff) < 3 && buff[1]&0x80 != 0) {
+		return 0, 0, nil
+	}
+	lenSize, length := DecodeInt(buff)
+	if lenSize == 3 && length < byteThreshold {
+		return 0, 0, newProtocolError("non canonical frame length %d", length)
+	}
+	if length < lenSize+2+2+2 {
+		return 0, 0, newProtocolError("frame length %d too short", length)
+	}
+	if length > maxFrameSize {
+		return 0, 0, newProtocolError("frame length %d exceeds %d", length, maxFrameSize)
+	}
+	return length, lenSize, nil
+}
+
+// DecodeFrame splits a complete frame into its service id, uri and header bytes.
+func DecodeFrame(frame []byte, lenSize int) (uint16, uint16, []byte, error) {
+	body := frame[lenSize:]
+	serviceId := binary.LittleEndian.Uint16(body[0:2])
+	uri := binary.LittleEndian.Uint16(body[2:4])
+	content := body[4:]
+	if len(content) < 3 && content[1]&0x80 != 0 {
+		return 0, 0, nil, newProtocolError("truncated content length")
+	}
+	cLenS, cLen := DecodeInt(content)
+	if cLenS == 3 && cLen < byteThreshold {
+		return 0, 0, nil, newProtocolError("non canonical content length %d", cLen)
+	}
+	if cLenS+cLen != len(content) {
+		return 0, 0, nil, newProtocolError("content length %d does not match frame length %d", cLen, len(frame))
+	}
+	return serviceId, uri, content[cLenS:], nil
 }
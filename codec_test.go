@@ -0,0 +1,191 @@
+package rtm2_sdk
+
+import (
+	"bytes"
+	"testing"
+)
+
+// flexVectors are the golden vectors documented in codec.go.
+var flexVectors = []struct {
+	value   int
+	encoded []byte
+}{
+	{0x0000, []byte{0x00, 0x00}},
+	{0x0001, []byte{0x01, 0x00}},
+	{0x7FFF, []byte{0xFF, 0x7F}},
+	{0x8000, []byte{0x00, 0x80, 0x01}},
+	{0x8001, []byte{0x01, 0x80, 0x01}},
+	{0x12345, []byte{0x45, 0xA3, 0x02}},
+	{0x3FFFFF, []byte{0xFF, 0xFF, 0x7F}},
+}
+
+func TestFlexLengthGoldenVectors(t *testing.T) {
+	for _, v := range flexVectors {
+		buffer := make([]byte, 3)
+		if err := EncodeInt(v.value, buffer); err != nil {
+			t.Fatalf("encode %#x: %v", v.value, err)
+		}
+		if !bytes.Equal(buffer[:len(v.encoded)], v.encoded) {
+			t.Fatalf("encode %#x: got % X, want % X", v.value, buffer[:len(v.encoded)], v.encoded)
+		}
+		size, value := DecodeInt(v.encoded)
+		if size != len(v.encoded) || value != v.value {
+			t.Fatalf("decode % X: got %#x in %d bytes, want %#x in %d", v.encoded, value, size, v.value, len(v.encoded))
+		}
+	}
+}
+
+func TestFlexLengthOutOfRange(t *testing.T) {
+	for _, value := range []int{-1, maxFrameSize + 1, 0x7FFFFF, 1 << 30} {
+		if err := EncodeInt(value, make([]byte, 3)); err != ErrLengthOverflow {
+			t.Fatalf("encode %#x: got %v, want ErrLengthOverflow", value, err)
+		}
+	}
+}
+
+func TestFlexLengthRoundTrip(t *testing.T) {
+	// every value around the 2/3 bytes boundary and the top of the range, then a stride over the rest
+	var values []int
+	for v := 0; v < 0x200; v++ {
+		values = append(values, v, byteThreshold-0x100+v, maxFrameSize-v)
+	}
+	for v := 0; v <= maxFrameSize; v += 0x101 {
+		values = append(values, v)
+	}
+	buffer := make([]byte, 3)
+	for _, v := range values {
+		checkFlexRoundTrip(t, v, buffer)
+	}
+}
+
+func checkFlexRoundTrip(t *testing.T, value int, buffer []byte) {
+	if err := EncodeInt(value, buffer); err != nil {
+		t.Fatalf("encode %#x: %v", value, err)
+	}
+	size, decoded := DecodeInt(buffer)
+	if decoded != value || size != contentLenSize(value) {
+		t.Fatalf("round trip %#x: got %#x in %d bytes", value, decoded, size)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	// message sizes putting the header and the frame on both sides of the 2/3 bytes boundary
+	for _, size := range []int{0, 1, byteThreshold - 16, byteThreshold - 8, byteThreshold, byteThreshold + 8, maxFrameSize - 64} {
+		h := &Header{Uri: UriMessageEvent, SeqId: 42, ErrCode: 7, ConnIndex: 3, Message: bytes.Repeat([]byte{0xA5}, size)}
+		frame := encodeTestFrame(h)
+		length, lenSize, err := DecodeFrameLen(frame)
+		if err != nil || length != len(frame) {
+			t.Fatalf("message of %d bytes: frame length %d, %v, want %d", size, length, err, len(frame))
+		}
+		serviceId, uri, content, err := DecodeFrame(frame, lenSize)
+		if err != nil || serviceId != serviceSubproxy || uri != UriCommonResp {
+			t.Fatalf("message of %d bytes: service %d uri %d, %v", size, serviceId, uri, err)
+		}
+		decoded := &Header{}
+		if err = decoded.Unmarshal(content); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.SeqId != h.SeqId || decoded.ErrCode != h.ErrCode || !bytes.Equal(decoded.Message, h.Message) {
+			t.Fatalf("message of %d bytes: header changed through the frame", size)
+		}
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	h := &Header{Message: make([]byte, maxFrameSize)}
+	size := h.Size()
+	if err := EncodeFrame(make([]byte, FrameSize(size)), serviceSubproxy, UriCommonRequest, h, size); err != ErrLengthOverflow {
+		t.Fatalf("got %v, want ErrLengthOverflow", err)
+	}
+}
+
+func FuzzFlexLength(f *testing.F) {
+	for _, v := range []int{0, 1, 0x7FFF, 0x8000, 0x8001, 0x3FFFFF, 0x400000, 0x7FFFFF} {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, value int) {
+		if value < 0 || value > maxFrameSize {
+			if err := EncodeInt(value, make([]byte, 3)); err != ErrLengthOverflow {
+				t.Fatalf("encode %#x: got %v, want ErrLengthOverflow", value, err)
+			}
+			return
+		}
+		checkFlexRoundTrip(t, value, make([]byte, 3))
+	})
+}
+
+func benchmarkEncodeFrame(b *testing.B, messageSize int) {
+	h := &Header{Uri: UriMessagePublish, SeqId: 1 << 40, ConnIndex: 3, Message: make([]byte, messageSize)}
+	size := h.Size()
+	buffer := make([]byte, FrameSize(size))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buffer)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := EncodeFrame(buffer, serviceSubproxy, UriCommonRequest, h, size); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeFrame(b *testing.B) {
+	b.Run("64B", func(b *testing.B) { benchmarkEncodeFrame(b, 64) })
+	b.Run("4KiB", func(b *testing.B) { benchmarkEncodeFrame(b, 4<<10) })
+	b.Run("1MiB", func(b *testing.B) { benchmarkEncodeFrame(b, 1<<20) })
+}
+
+func FuzzDecodeFrameLen(f *testing.F) {
+	for _, seed := range [][]byte{{0x0A, 0x00}, {0xFF, 0x7F}, {0x00, 0x80, 0x01}, {0xFF, 0xFF, 0xFF}, {0x00, 0x80, 0x00}, {0x01}} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		length, lenSize, err := DecodeFrameLen(data)
+		if err != nil || length == 0 {
+			return
+		}
+		if lenSize != 2 && lenSize != 3 {
+			t.Fatalf("length size %d", lenSize)
+		}
+		if length < lenSize+6 || length > maxFrameSize {
+			t.Fatalf("length %d accepted", length)
+		}
+		// a length accepted is canonical: encoding it again gives the same bytes
+		buffer := make([]byte, 3)
+		if err := EncodeInt(length, buffer); err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer[:lenSize]) != string(data[:lenSize]) {
+			t.Fatalf("length %d decoded from % X encodes to % X", length, data[:lenSize], buffer[:lenSize])
+		}
+	})
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	f.Add(encodeTestFrame(&Header{Uri: UriLogin, SeqId: 1}))
+	f.Add(encodeTestFrame(&Header{Uri: UriMessageEvent, Message: make([]byte, byteThreshold)}))
+	f.Add([]byte{0x08, 0x00, 0x4C, 0x09, 0xFF, 0x0F, 0x00, 0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		length, lenSize, err := DecodeFrameLen(data)
+		if err != nil || length == 0 || len(data) < length {
+			return
+		}
+		_, _, content, err := DecodeFrame(data[:length], lenSize)
+		if err != nil {
+			return
+		}
+		if len(content) > length {
+			t.Fatalf("content of %d bytes out of a %d bytes frame", len(content), length)
+		}
+		h := &Header{}
+		_ = h.Unmarshal(content)
+	})
+}
+
+func TestFrameLenAboveMaximum(t *testing.T) {
+	// 0x400000 and up set the high bit of the third byte, which the SDK never writes
+	for _, prefix := range [][]byte{{0x00, 0x80, 0x80}, {0xFF, 0xFF, 0xFF}} {
+		if _, _, err := DecodeFrameLen(prefix); err == nil {
+			t.Fatalf("frame length % X accepted", prefix)
+		}
+	}
+}
@@ -2,8 +2,6 @@ package rtm2_sdk
 
 import (
 	"context"
-	"encoding/binary"
-	"errors"
 	"github.com/cloudwego/netpoll"
 	"github.com/tevino/abool/v2"
 	"go.uber.org/zap"
@@ -16,6 +14,9 @@ const defaultChannelSize = 4096
 const defaultFlushSize = 1024 * 1024
 const serviceSubproxy = 2380 // todo change service id
 
+// defaultStableLink is how long a link must stay up before the reconnect budget is refilled.
+const defaultStableLink = time.Second * 5
+
 type Marshalable interface {
 	MarshalTo([]byte) (int, error)
 	Marshal() ([]byte, error)
@@ -26,58 +27,256 @@ type connectionCallback interface {
 	onResponse(uri int32, errCode int32, message []byte) error
 }
 
+// connectionConfig holds the tunables of a connection, see connectionConfigFromParams.
+type connectionConfig struct {
+	reconnect     backoff
+	stableLink    time.Duration
+	pendingTTL    time.Duration
+	sweepInterval time.Duration
+	queueSize     int
+	queuePolicy   QueuePolicy
+	maxFrameSize  int
+
+	metadataWeight int
+	dataWeight     int
+
+	eventQueueSize int
+	eventPolicy    QueuePolicy
+}
+
+func defaultConnectionConfig() *connectionConfig {
+	return &connectionConfig{
+		reconnect:     defaultBackoff(),
+		stableLink:    defaultStableLink,
+		pendingTTL:    defaultPendingTTL,
+		sweepInterval: defaultSweepInterval,
+		queueSize:     defaultChannelSize,
+		queuePolicy:   QueueFailFast,
+		maxFrameSize:  maxFrameSize,
+
+		metadataWeight: defaultMetadataWeight,
+		dataWeight:     defaultDataWeight,
+
+		eventQueueSize: defaultEventQueueSize,
+		eventPolicy:    QueueDropOldest,
+	}
+}
+
+func connectionConfigFromParams(params map[string]interface{}) *connectionConfig {
+	config := defaultConnectionConfig()
+	config.reconnect.retries = int(paramInt32(params, kParamReconnectRetries, int32(config.reconnect.retries)))
+	config.reconnect.initial = paramMillis(params, kParamReconnectBackoff, config.reconnect.initial)
+	config.reconnect.max = paramMillis(params, kParamReconnectMaxBackoff, config.reconnect.max)
+	config.reconnect.jitter = paramFloat64(params, kParamReconnectJitter, config.reconnect.jitter)
+	if size := paramInt32(params, kParamQueueSize, int32(config.queueSize)); size > 0 {
+		config.queueSize = int(size)
+	}
+	if policy, ok := params[kParamQueuePolicy].(QueuePolicy); ok {
+		config.queuePolicy = policy
+	} else {
+		config.queuePolicy = QueuePolicy(paramInt32(params, kParamQueuePolicy, int32(config.queuePolicy)))
+	}
+	if size := paramInt32(params, kParamMaxFrameSize, int32(config.maxFrameSize)); size > 0 && size <= maxFrameSize {
+		config.maxFrameSize = int(size)
+	}
+	if weight := paramInt32(params, kParamMetadataWeight, int32(config.metadataWeight)); weight > 0 {
+		config.metadataWeight = int(weight)
+	}
+	if weight := paramInt32(params, kParamDataWeight, int32(config.dataWeight)); weight > 0 {
+		config.dataWeight = int(weight)
+	}
+	if size := paramInt32(params, kParamEventQueueSize, int32(config.eventQueueSize)); size > 0 {
+		config.eventQueueSize = int(size)
+	}
+	if policy, ok := params[kParamEventPolicy].(QueuePolicy); ok {
+		config.eventPolicy = policy
+	} else {
+		config.eventPolicy = QueuePolicy(paramInt32(params, kParamEventPolicy, int32(config.eventPolicy)))
+	}
+	return config
+}
+
+// spawnedConnectionConfig is connectionConfigFromParams for a sidecar the SDK supervises. Its links are redialed
+// for as long as the supervisor restarts it, the supervisor reports the failure once its own budget is spent.
+func spawnedConnectionConfig(params map[string]interface{}) *connectionConfig {
+	config := connectionConfigFromParams(params)
+	config.reconnect.retries = 0
+	return config
+}
+
 type connection struct {
 	ctx      context.Context
 	cancel   context.CancelFunc
 	lg       *zap.Logger
+	config   *connectionConfig
 	callback connectionCallback
-	edp      string
-	req      chan *Header
-	resp     chan *Header
-	requests sync.Map
+	routes   sync.Map
+	lanes    *lanes
+	events   *eventDispatcher
+	requests *pendingTable
+	stats    connectionStats
 	seqId    int64
 	errChan  chan error
 	start    abool.AtomicBool
-	conn     netpoll.Connection
+	wake     chan struct{}
+	// reconnected is signaled each time the link is established again, see Reconnected
+	reconnected chan struct{}
+	// link and dedup are set on the links of a pool, which share c.events
+	link  int
+	dedup *eventDedup
+
+	mu     sync.Mutex
+	edp    string
+	conn   netpoll.Connection
+	closed chan struct{}
 }
 
-func NewConnection(gCtx context.Context, lg *zap.Logger, edp string, callback connectionCallback) *connection {
+func NewConnection(gCtx context.Context, lg *zap.Logger, edp string, config *connectionConfig, callback connectionCallback) *connection {
 	ctx, cancel := context.WithCancel(gCtx)
+	if config == nil {
+		config = defaultConnectionConfig()
+	}
 	ret := &connection{
 		ctx:      ctx,
 		cancel:   cancel,
-		lg:       lg.With(zap.String("endpoint", edp)),
+		lg:       lg,
+		config:   config,
 		callback: callback,
 		edp:      edp,
-		req:      make(chan *Header, defaultChannelSize),
-		resp:     make(chan *Header, defaultChannelSize),
+		lanes:    newLanes(config.queueSize, config.metadataWeight, config.dataWeight),
+		requests: newPendingTable(),
 		errChan:  make(chan error, 10),
-	}
+		wake:     make(chan struct{}, 1),
 
+		reconnected: make(chan struct{}, 1),
+	}
+	ret.events = newEventDispatcher(ctx, lg, config.eventQueueSize, config.eventPolicy, ret.onEvent)
 	return ret
 }
 
 func (c *connection) Start() {
 	if c.start.SetToIf(false, true) {
 		go c.loop()
+		go c.sweep()
 	}
 }
 
-func (c *connection) SendRequest(header *Header, rc chan<- *Header) error {
-	seqId := atomic.AddInt64(&c.seqId, 1)
+// SendRequest queues header, the reply is delivered to rc unless ctx ends first.
+// Without a deadline on ctx the request is kept pending for pendingTTL at most.
+// When the queue is full the configured QueuePolicy applies.
+func (c *connection) SendRequest(ctx context.Context, header *Header, rc chan<- *Header) error {
+	if FrameSize(header.Size()) > maxFrameSize {
+		return ErrLengthOverflow
+	}
+	header.SeqId = atomic.AddInt64(&c.seqId, 1)
+	r := &request{header: header, rc: rc}
 	if rc != nil {
-		c.requests.Store(seqId, rc)
+		if deadline, ok := ctx.Deadline(); ok {
+			r.deadline = deadline
+		} else {
+			r.deadline = time.Now().Add(c.config.pendingTTL)
+		}
+		c.requests.add(r)
+	}
+	if err := c.enqueue(ctx, r); err != nil {
+		c.requests.take(header.SeqId)
+		atomic.AddInt64(&c.stats.rejected, 1)
+		c.lg.Warn("failed to queue request", zap.Int32("uri", header.Uri), zap.Int64("seqid", header.SeqId), zap.Error(err))
+		return err
 	}
-	header.SeqId = seqId
+	return nil
+}
+
+func (c *connection) enqueue(ctx context.Context, r *request) error {
+	queue := c.lanes.of(r)
 	select {
-	case c.req <- header:
+	case queue <- r:
 		return nil
 	default:
-		c.lg.Warn("channel full")
-		return errors.New("channel full")
+	}
+	switch c.config.queuePolicy {
+	case QueueBlock:
+		select {
+		case queue <- r:
+			return nil
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrQueueFull
+			}
+			return ctx.Err()
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case queue <- r:
+				return nil
+			case old := <-queue:
+				c.drop(old)
+			}
+		}
+	default:
+		return ErrQueueFull
 	}
 }
 
+// drop evicts a queued request, its waiter is answered with ErrQueueFull.
+func (c *connection) drop(r *request) {
+	atomic.AddInt64(&c.stats.dropped, 1)
+	c.lg.Warn("drop oldest request", zap.Int32("uri", r.header.Uri), zap.Int64("seqid", r.header.SeqId))
+	if pending := c.requests.take(r.header.SeqId); pending != nil {
+		pending.rc <- &Header{Uri: r.header.Uri, SeqId: r.header.SeqId, ErrCode: ErrCodeQueueFull}
+	}
+}
+
+// CancelRequest forgets a pending request, a reply arriving later is dropped.
+// A request still waiting in the queue will not be sent at all.
+func (c *connection) CancelRequest(seqId int64) {
+	if c.requests.take(seqId) != nil {
+		atomic.AddInt64(&c.stats.canceled, 1)
+	}
+}
+
+// sweep periodically drops pending requests past their deadline, in case their waiter never canceled them.
+func (c *connection) sweep() {
+	ticker := time.NewTicker(c.config.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if count := c.requests.sweep(now); count > 0 {
+				atomic.AddInt64(&c.stats.expired, int64(count))
+				c.lg.Warn("expired pending requests", zap.Int("count", count))
+			}
+		}
+	}
+}
+
+// Route delivers the events tagged with index to callback, a nil callback removes the route.
+// Events without a route go to the callback the connection was created with.
+func (c *connection) Route(index uint64, callback connectionCallback) {
+	if callback == nil {
+		c.routes.Delete(index)
+	} else {
+		c.routes.Store(index, callback)
+	}
+}
+
+func (c *connection) route(index uint64) connectionCallback {
+	if index != 0 {
+		if callback, ok := c.routes.Load(index); ok {
+			return callback.(connectionCallback)
+		}
+	}
+	return c.callback
+}
+
+// onEvent hands an event to the client it is routed to, it runs on the dispatcher.
+func (c *connection) onEvent(h *Header) error {
+	return c.route(h.ConnIndex).onResponse(h.Uri, h.ErrCode, h.Message)
+}
+
 func (c *connection) ErrorChan() <-chan error {
 	return c.errChan
 }
@@ -86,6 +285,8 @@ func (c *connection) onError(err error) {
 	c.errChan <- err
 }
 
+// loop keeps the link to the sidecar alive, redialing with backoff whenever it drops.
+// Requests queued in c.lanes survive a reconnect, only the ones already written to a dead link are failed.
 func (c *connection) loop() {
 	c.lg.Info("Start loop")
 	var err error
@@ -94,149 +295,293 @@ func (c *connection) loop() {
 		if err != nil {
 			c.onError(err)
 		}
-		if c.conn != nil {
-			_ = c.conn.Close()
+		if conn, _ := c.current(); conn != nil {
+			_ = conn.Close()
 		}
+		c.failRequests(false)
 	}()
 
+	attempt := 0
+	dialed := false
+	var lastErr error
 	for c.start.IsSet() {
-		if err := c.dial(); err != nil {
-			c.lg.Error("failed to dial", zap.Error(err))
-			time.Sleep(time.Millisecond * 100)
-			continue
-		}
-		ctx := c.ctx
-		for {
+		if attempt > 0 {
+			if c.config.reconnect.exhausted(attempt) {
+				c.lg.Error("reconnect budget exhausted", zap.Int("attempts", attempt), zap.Error(lastErr))
+				err = ERR_DISCONNECTED
+				return
+			}
+			delay := c.config.reconnect.delay(attempt)
+			c.lg.Warn("reconnect later", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(lastErr))
 			select {
-			case <-ctx.Done():
+			case <-c.ctx.Done():
 				c.lg.Warn("context canceled")
 				return
-			case h := <-c.req:
-				count := h.Size()
-				if err = c.send(h); err != nil {
-					c.lg.Error("Failed to send", zap.Error(err))
-					return
-				}
-				for len(c.req) > 0 && count < defaultFlushSize {
-					h = <-c.req
-					if err = c.send(h); err != nil {
-						c.lg.Error("Failed to send", zap.Error(err))
-						return
-					}
-					count += h.Size()
-				}
-				if err = c.conn.Writer().Flush(); err != nil {
-					c.lg.Error("Failed to flush buffer", zap.Error(err))
-					return
-				}
-			case h := <-c.resp:
-				if err = c.callback.onResponse(h.Uri, h.ErrCode, h.Message); err != nil {
-					c.lg.Error("Failed to handle response", zap.Any("header", h))
-					return
-				}
+			case <-time.After(delay):
+			case <-c.wake:
+				attempt = 0
+			}
+		}
+		if lastErr = c.dial(); lastErr != nil {
+			attempt++
+			continue
+		}
+		if c.dedup != nil {
+			c.dedup.rejoin(c.link)
+		}
+		if dialed {
+			select {
+			case c.reconnected <- struct{}{}:
+			default:
 			}
 		}
+		dialed = true
+		up := time.Now()
+		if err = c.serve(); err != nil {
+			return
+		}
+		if c.ctx.Err() != nil {
+			c.lg.Warn("context canceled")
+			return
+		}
+		// a link lost right after connecting counts as a failed attempt, a sidecar accepting then dropping
+		// every link must not be redialed in a tight loop forever
+		if time.Since(up) < c.config.stableLink {
+			attempt++
+			lastErr = ERR_DISCONNECTED
+		} else {
+			attempt = 0
+		}
+		c.lg.Warn("connection lost, reconnecting", zap.Duration("up", time.Since(up)))
+	}
+}
+
+// serve writes requests over the current link until it is closed, events are handed over by c.events.
+// It returns nil when the link is lost and a non-nil error only for fatal failures.
+func (c *connection) serve() error {
+	conn, closed := c.current()
+	for {
+		// every batch starts in lane order, the writer blocks only when every lane is empty
+		r := c.lanes.next()
+		if r == nil {
+			select {
+			case <-c.ctx.Done():
+				return nil
+			case <-closed:
+				return nil
+			case r = <-c.lanes.queues[laneControl]:
+			case r = <-c.lanes.queues[laneMetadata]:
+			case r = <-c.lanes.queues[laneData]:
+			}
+		}
+		// a control request queued meanwhile is written next
+		for count := 0; ; {
+			n, err := c.send(conn, r)
+			if err != nil {
+				c.lg.Error("Failed to send", zap.Error(err))
+				return c.abort(conn, closed)
+			}
+			if count += n; count >= defaultFlushSize {
+				break
+			}
+			if r = c.lanes.next(); r == nil {
+				break
+			}
+		}
+		if err := conn.Writer().Flush(); err != nil {
+			c.lg.Error("Failed to flush buffer", zap.Error(err))
+			return c.abort(conn, closed)
+		}
+	}
+}
+
+// abort closes a broken link and waits for its close callback to fail the in-flight requests.
+func (c *connection) abort(conn netpoll.Connection, closed <-chan struct{}) error {
+	_ = conn.Close()
+	select {
+	case <-c.ctx.Done():
+	case <-closed:
+	}
+	return nil
+}
+
+func (c *connection) current() (netpoll.Connection, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.closed
+}
+
+// Reconnected is signaled each time the link is established again after the first dial. Signals not
+// consumed yet are merged into one.
+func (c *connection) Reconnected() <-chan struct{} {
+	return c.reconnected
+}
+
+// Redial cuts a reconnect backoff short and refills the budget, the sidecar has been restarted and listens again.
+func (c *connection) Redial() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetEndpoint changes where the next dial goes, the current link is left alone.
+func (c *connection) SetEndpoint(edp string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.edp != edp {
+		c.lg.Info("endpoint changed", zap.String("from", c.edp), zap.String("to", edp))
+		c.edp = edp
 	}
 }
 
 func (c *connection) dial() error {
-	c.lg.Info("start dial")
-	if conn, err := netpoll.DialConnection("tcp", c.edp, time.Second*5); err != nil {
-		c.lg.Error("Failed to dial connection", zap.Error(err))
+	c.mu.Lock()
+	edp := c.edp
+	c.mu.Unlock()
+	c.lg.Info("start dial", zap.String("endpoint", edp))
+	network, address := splitEndpoint(edp)
+	if conn, err := netpoll.DialConnection(network, address, time.Second*5); err != nil {
+		c.lg.Error("Failed to dial connection", zap.String("endpoint", edp), zap.Error(err))
 		return err
 	} else {
+		c.mu.Lock()
 		c.conn = conn
+		c.closed = make(chan struct{})
+		c.mu.Unlock()
 		_ = conn.SetOnRequest(c.onRequest)
 		_ = conn.AddCloseCallback(c.onClose)
-		c.lg.Info("connected")
+		c.lg.Info("connected", zap.String("endpoint", edp))
 	}
 	return nil
 }
 
-// todo optimize performance
-func (c *connection) send(h *Header) error {
-	cLenS := 2
-	if h.Size() >= byteThreshold {
-		cLenS = 3
+// send marshals the header straight into the writer buffer and returns the bytes written.
+func (c *connection) send(conn netpoll.Connection, r *request) (int, error) {
+	h := r.header
+	if r.rc != nil {
+		if !c.requests.contains(h.SeqId) {
+			c.lg.Debug("skip canceled request", zap.Int64("seqid", h.SeqId))
+			return 0, nil
+		}
+		atomic.StoreInt32(&r.sent, 1)
 	}
-	length, _ := TotalWithLength(h.Size() + 2 + 2 + cLenS)
-	buffer, err := c.conn.Writer().Malloc(length)
+	size := h.Size()
+	length := FrameSize(size)
+	buffer, err := conn.Writer().Malloc(length)
 	if err != nil {
 		c.lg.Error("Failed to send", zap.Error(err))
-		return err
+		return 0, err
 	}
-	body := make([]byte, h.Size()+2+2+cLenS)
-
-	_, err = h.MarshalTo(body[2+2+cLenS:])
-	if err != nil {
-		return err
+	if err = EncodeFrame(buffer, serviceSubproxy, UriCommonRequest, h, size); err != nil {
+		return 0, err
 	}
-	binary.LittleEndian.PutUint16(body[0:2], serviceSubproxy)
-	binary.LittleEndian.PutUint16(body[2:4], UriCommonRequest)
-	EncodeInt(h.Size(), body[4:4+cLenS])
-	EncodeLen(body, buffer)
-	c.lg.Debug("buffer", zap.ByteString("buffer", buffer), zap.Int("length", length), zap.Int("header size", h.Size()), zap.Int64("seqid", h.SeqId))
-	return err
+	if ce := c.lg.Check(zap.DebugLevel, "buffer"); ce != nil {
+		ce.Write(zap.ByteString("buffer", buffer), zap.Int("length", length), zap.Int("header size", size), zap.Int64("seqid", h.SeqId))
+	}
+	return length, nil
 }
 
+// onRequest drains every complete frame buffered on the link, a partial frame is left for the next callback.
+// Malformed or oversized frames leave the stream out of sync, so the link is closed and redialed.
 func (c *connection) onRequest(ctx context.Context, connection netpoll.Connection) error {
-	if c.conn == nil || c.conn.LocalAddr() != connection.LocalAddr() {
+	if conn, _ := c.current(); conn == nil || conn.LocalAddr() != connection.LocalAddr() {
 		c.lg.Info("wrong conn", zap.String("local", connection.LocalAddr().String()))
 		connection.Close()
 		return nil
 	}
 	c.lg.Debug("request incoming", zap.String("local", connection.LocalAddr().String()))
-	lenByte, err := c.conn.Reader().Peek(3)
-	if err != nil {
-		c.lg.Error("Failed to peek", zap.Error(err))
-		return err
-	}
-	lenSize, length := DecodeInt(lenByte)
-	buffer, err := c.conn.Reader().Next(length)
-	if err != nil {
-		c.lg.Error("Failed to read", zap.Error(err))
-		return err
-	}
-	h := &Header{}
-	// len(flex) + uri + service_id + content_length(flex)
-	cLen, _ := DecodeInt(buffer[lenSize+2+2:])
-	err = h.Unmarshal(buffer[lenSize+2+2+cLen:])
-	if err != nil {
-		c.lg.Error("unmarshal header error", zap.Error(err))
-		return err
+	reader := connection.Reader()
+	for {
+		available := reader.Len()
+		if available < 2 {
+			return nil
+		}
+		if available > 3 {
+			available = 3
+		}
+		lenByte, err := reader.Peek(available)
+		if err != nil {
+			c.lg.Error("Failed to peek", zap.Error(err))
+			return err
+		}
+		length, lenSize, err := DecodeFrameLen(lenByte)
+		if err == nil && length > c.config.maxFrameSize {
+			err = newProtocolError("frame length %d exceeds %d", length, c.config.maxFrameSize)
+		}
+		if err != nil {
+			return c.onProtocolError(connection, err)
+		}
+		if length == 0 || reader.Len() < length {
+			return nil
+		}
+		buffer, err := reader.Next(length)
+		if err != nil {
+			c.lg.Error("Failed to read", zap.Error(err))
+			return err
+		}
+		_, _, content, err := DecodeFrame(buffer, lenSize)
+		if err != nil {
+			return c.onProtocolError(connection, err)
+		}
+		h := &Header{}
+		err = h.Unmarshal(content)
+		_ = reader.Release()
+		if err != nil {
+			c.lg.Error("unmarshal header error", zap.Error(err))
+			return c.onProtocolError(connection, err)
+		}
+		c.lg.Debug("on request", zap.Int("length", length), zap.Any("header", h))
+		c.dispatch(h)
 	}
-	_ = c.conn.Reader().Release()
-	c.lg.Debug("on request", zap.Int("length", len(buffer)), zap.Any("header", h))
-	if IsEvent(h.Uri) {
-		c.resp <- h
-	} else {
-		if value, ok := c.requests.LoadAndDelete(h.SeqId); ok {
-			rc := value.(chan<- *Header)
-			rc <- h
-		} else {
-			c.lg.Error("cannot find seqid", zap.Int64("seqid", h.SeqId))
+}
+
+func (c *connection) onProtocolError(connection netpoll.Connection, err error) error {
+	c.lg.Error("protocol error, reset connection", zap.Error(err))
+	_ = connection.Close()
+	return err
+}
+
+// dispatch matches a frame to its pending request first, so that an Invoke on a uri subscribed with SubscribeRaw
+// gets its reply, and only then takes it for an event. A frame on an event uri answers a request of that uri
+// only, an event whose SeqId happens to be pending for another uri is still an event.
+func (c *connection) dispatch(h *Header) {
+	event := IsEvent(h.Uri)
+	if r := c.requests.takeIf(h.SeqId, func(r *request) bool { return !event || r.header.Uri == h.Uri }); r != nil {
+		r.rc <- h
+	} else if event {
+		if c.dedup != nil && !c.dedup.first(c.link, h) {
+			atomic.AddInt64(&c.stats.duplicates, 1)
+			return
 		}
-		return nil
+		c.events.push(h)
+	} else {
+		atomic.AddInt64(&c.stats.lateReplies, 1)
+		c.lg.Warn("late reply, cannot find seqid", zap.Int64("seqid", h.SeqId), zap.Int32("uri", h.Uri))
 	}
-	return nil
 }
 
 func (c *connection) onClose(connection netpoll.Connection) error {
-	if c.conn.LocalAddr() != connection.LocalAddr() {
+	conn, closed := c.current()
+	if conn == nil || conn.LocalAddr() != connection.LocalAddr() {
 		c.lg.Warn("Wrong connection", zap.String("wrong", connection.RemoteAddr().String()))
 		return nil
 	}
 
 	c.lg.Info("Connection closed")
-	c.onError(ERR_DISCONNECTED)
-	c.cancel()
-	c.requests.Range(func(key, value interface{}) bool {
-		seqid := key.(int64)
-		rc := value.(chan<- *Header)
-		close(rc)
-		c.lg.Error("disconnect", zap.Int64("seqid", seqid))
-		c.requests.Delete(key)
-		return true
-	})
+	// requests still queued will be sent after reconnecting
+	c.failRequests(true)
+	close(closed)
 	return nil
 }
+
+// failRequests closes the reply channel of pending requests, so that their waiters get ERR_DISCONNECTED.
+func (c *connection) failRequests(onlySent bool) {
+	var filter func(r *request) bool
+	if onlySent {
+		filter = (*request).isSent
+	}
+	for _, seqId := range c.requests.fail(filter) {
+		c.lg.Error("disconnect", zap.Int64("seqid", seqId))
+	}
+}
@@ -0,0 +1,214 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectBudgetCountsDroppedLinks(t *testing.T) {
+	s := newFakeSidecar(t, nil)
+	s.drop.Set()
+	config := defaultConnectionConfig()
+	config.reconnect.retries = 3
+	config.reconnect.initial = 10 * time.Millisecond
+	config.reconnect.max = 20 * time.Millisecond
+	c := startConnection(t, s.addr(), config, nil)
+
+	select {
+	case err := <-c.ErrorChan():
+		if !errors.Is(err, ERR_DISCONNECTED) {
+			t.Fatalf("got %v, want ERR_DISCONNECTED", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no error after %d links accepted then dropped", atomic.LoadInt32(&s.accepted))
+	}
+	if accepted := atomic.LoadInt32(&s.accepted); accepted != 4 {
+		t.Fatalf("accepted %d links, want the first one and 3 retries", accepted)
+	}
+}
+
+func TestReconnectAfterStableLink(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	config := defaultConnectionConfig()
+	config.reconnect.retries = 1
+	config.stableLink = 10 * time.Millisecond
+	c := startConnection(t, s.addr(), config, nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := roundTrip(t, c, UriPresenceWhoNow, time.Second); err != nil {
+			t.Fatalf("round trip %d: %v", i, err)
+		}
+		time.Sleep(2 * config.stableLink)
+		s.disconnect()
+		want := int32(i + 2)
+		waitFor(t, time.Second, func() bool { return atomic.LoadInt32(&s.accepted) == want })
+	}
+	select {
+	case err := <-c.ErrorChan():
+		t.Fatalf("stable links must refill the budget, got %v", err)
+	default:
+	}
+}
+
+func TestOnRequestDrainsEveryFrameOfABuffer(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	callback := newEvents()
+	c := startConnection(t, s.addr(), nil, callback)
+	// the link is up once a request went through
+	if _, err := roundTrip(t, c, UriPresenceWhoNow, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// small and large frames, 2 and 3 bytes length prefixes, in a single write
+	var frames []*Header
+	for i := 0; i < 10; i++ {
+		size := 16
+		if i%3 == 0 {
+			size = byteThreshold + i
+		}
+		frames = append(frames, &Header{Uri: UriMessageEvent, Message: make([]byte, size)})
+	}
+	s.push(frames...)
+	for i := range frames {
+		select {
+		case h := <-callback.ch:
+			if len(h.Message) != len(frames[i].Message) {
+				t.Fatalf("event %d carries %d bytes, want %d", i, len(h.Message), len(frames[i].Message))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d events out of %d", i, len(frames))
+		}
+	}
+}
+
+func TestRedialCutsTheBackoffShort(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	addr := s.addr()
+	s.close()
+	config := defaultConnectionConfig()
+	config.reconnect.retries = 0
+	config.reconnect.initial = time.Minute
+	config.reconnect.max = time.Minute
+	c := startConnection(t, addr, config, nil)
+	time.Sleep(50 * time.Millisecond) // the first dial fails, the next one is a minute away
+
+	listenFakeSidecar(t, addr, echo)
+	c.Redial()
+	if _, err := roundTrip(t, c, UriPresenceWhoNow, time.Second); err != nil {
+		t.Fatalf("redial did not cut the backoff short: %v", err)
+	}
+}
+
+// stuckHandler never returns from an event until release is closed.
+type stuckHandler struct {
+	release chan struct{}
+}
+
+func (s *stuckHandler) onResponse(uri int32, errCode int32, message []byte) error {
+	<-s.release
+	return nil
+}
+
+func TestFullEventQueueDoesNotHoldReplies(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	config := defaultConnectionConfig()
+	config.eventQueueSize = 2
+	handler := &stuckHandler{release: make(chan struct{})}
+	defer close(handler.release)
+	c := startConnection(t, s.addr(), config, handler)
+	if _, err := roundTrip(t, c, UriPresenceWhoNow, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for k := 0; k < 10; k++ {
+		s.push(&Header{Uri: UriMessageEvent})
+	}
+	waitFor(t, time.Second, func() bool { return c.Stats().Events.Dropped > 0 })
+	if _, err := roundTrip(t, c, UriPresenceWhoNow, time.Second); err != nil {
+		t.Fatalf("reply held behind a full event queue: %v", err)
+	}
+}
+
+func TestControlEventsAreNeverDropped(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []int64
+	handle := func(h *Header) error {
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		if h.Uri == UriLockEvent {
+			got = append(got, h.SeqId)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newEventDispatcher(ctx, zap.NewNop(), 2, QueueDropOldest, handle)
+
+	const count = 10
+	for k := int64(1); k <= count; k++ {
+		d.push(&Header{Uri: UriMessageEvent, SeqId: k})
+		d.push(&Header{Uri: UriLockEvent, SeqId: k})
+	}
+	stats := d.Stats()
+	if stats.ByUri[UriMessageEvent].Dropped == 0 {
+		t.Fatal("message events were not dropped")
+	}
+	if lock := stats.ByUri[UriLockEvent]; lock.Dropped != 0 || lock.QueueDepth+1 < count {
+		t.Fatalf("lock events: %+v", lock)
+	}
+	close(release)
+	waitFor(t, time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == count
+	})
+	for k, seqId := range got {
+		if seqId != int64(k+1) {
+			t.Fatalf("lock events out of order: %v", got)
+		}
+	}
+}
+
+func TestEventWithPendingSeqIdStaysAnEvent(t *testing.T) {
+	s := newFakeSidecar(t, nil) // requests are answered by hand
+	callback := newEvents()
+	c := startConnection(t, s.addr(), nil, callback)
+	rc := make(chan *Header, 1)
+	h := &Header{Uri: UriPresenceWhoNow}
+	if err := c.SendRequest(context.Background(), h, rc); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, func() bool { return len(s.requests()) == 1 })
+
+	s.push(&Header{Uri: UriMessageEvent, SeqId: h.SeqId, Message: []byte("event")})
+	select {
+	case e := <-callback.ch:
+		if string(e.Message) != "event" {
+			t.Fatalf("got event %q", e.Message)
+		}
+	case <-rc:
+		t.Fatal("the event was taken for the reply")
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+
+	s.push(&Header{Uri: UriPresenceWhoNow, SeqId: h.SeqId})
+	select {
+	case resp := <-rc:
+		if resp.Uri != UriPresenceWhoNow {
+			t.Fatalf("got reply of uri %d", resp.Uri)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request lost its reply")
+	}
+	if n := c.requests.len(); n != 0 {
+		t.Fatalf("%d requests still pending", n)
+	}
+}
@@ -54,13 +54,71 @@ const (
 
 	invalidUri = -1
 
-	kParamSidecarEndpoint = "golang_sidecar_endpoint"
-	kParamSidecarPort     = "golang_sidecar_port"
-	kParamSidecarPath     = "golang_sidecar_path"
+	kParamSidecarEndpoint  = "golang_sidecar_endpoint"
+	kParamSidecarPort      = "golang_sidecar_port"
+	kParamSidecarPath      = "golang_sidecar_path"
+	kParamSidecarTransport = "golang_sidecar_transport"
+	kParamSidecarShared    = "golang_sidecar_shared"
+	kParamSidecarBinary    = "golang_sidecar_binary"
+	kParamSidecarArgs      = "golang_sidecar_args"
+	kParamSidecarDir       = "golang_sidecar_dir"
+	kParamSidecarLibPath   = "golang_sidecar_lib_path"
+	kParamSidecarEnv       = "golang_sidecar_env"
+	kParamSidecarRlimits   = "golang_sidecar_rlimits"
 
+	kParamSidecarRestartRetries    = "golang_sidecar_restart_retries"
+	kParamSidecarRestartBackoff    = "golang_sidecar_restart_backoff_ms"
+	kParamSidecarRestartMaxBackoff = "golang_sidecar_restart_max_backoff_ms"
+	kParamSidecarReadyTimeout      = "golang_sidecar_ready_timeout_ms"
+	kParamSidecarStopGrace         = "golang_sidecar_stop_grace_ms"
+	kParamSidecarLogRate           = "golang_sidecar_log_rate"
+	kParamSidecarLogTail           = "golang_sidecar_log_tail"
+
+	kParamReconnectRetries    = "golang_reconnect_retries"
+	kParamReconnectBackoff    = "golang_reconnect_backoff_ms"
+	kParamReconnectMaxBackoff = "golang_reconnect_max_backoff_ms"
+	kParamReconnectJitter     = "golang_reconnect_jitter"
+
+	kParamConnections = "golang_connections"
+	kParamQueueSize   = "golang_queue_size"
+	kParamQueuePolicy = "golang_queue_policy"
+
+	kParamMetadataWeight = "golang_queue_metadata_weight"
+	kParamDataWeight     = "golang_queue_data_weight"
+
+	kParamEventQueueSize = "golang_event_queue_size"
+	kParamEventPolicy    = "golang_event_policy"
+
+	kParamMaxFrameSize = "golang_max_frame_size"
+
+	kParamRequestTimeout  = "golang_request_timeout_ms"
+	kParamRequestTimeouts = "golang_request_timeouts_ms"
+
+	kParamRetries         = "golang_retries"
+	kParamRetryBackoff    = "golang_retry_backoff_ms"
+	kParamRetryMaxBackoff = "golang_retry_max_backoff_ms"
+	kParamRetryUris       = "golang_retry_uris"
+
+	kParamSubListLocal = "golang_sub_list_local"
+	kParamSubListUri   = "golang_sub_list_uri"
+
+	// DefaultSidecarPort was the port of every spawned sidecar, they now listen on a free port
+	// unless golang_sidecar_port is set.
 	DefaultSidecarPort = 7001
 )
 
+// QueuePolicy decides what SendRequest does when the outgoing queue is full.
+type QueuePolicy int32
+
+const (
+	// QueueFailFast rejects the new request with ErrQueueFull.
+	QueueFailFast QueuePolicy = 0
+	// QueueBlock waits for room until the request context is done.
+	QueueBlock QueuePolicy = 1
+	// QueueDropOldest evicts the oldest queued request, whose waiter gets ErrQueueFull.
+	QueueDropOldest QueuePolicy = 2
+)
+
 // channel type
 const (
 	Msg    = 0
@@ -74,10 +132,7 @@ const (
 	TopicEventLeave    = 2
 )
 
+// IsEvent reports whether uri is registered as an event pushed by the sidecar, see RegisterEvent and SubscribeRaw.
 func IsEvent(uri int32) bool {
-	switch uri {
-	case UriMessageEvent, UriStreamEvent, UriStreamTopicEvent, UriStorageChannelEvent, UriStorageUserEvent, UriConnectStateChange, UriPresenceEvent, UriLockEvent, UriTokenPrivilegeExpire:
-		return true
-	}
-	return false
+	return registry.isEvent(uri)
 }
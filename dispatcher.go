@@ -0,0 +1,167 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultEventQueueSize = 1024
+
+// controlEvents are never dropped whatever the policy: losing a connection state change, a token expiry
+// or a lock event would leave the client with a wrong view of its session.
+var controlEvents = map[int32]bool{
+	UriConnectStateChange:   true,
+	UriTokenPrivilegeExpire: true,
+	UriLockEvent:            true,
+}
+
+// eventQueue holds the events of one uri, they are handed to the client in order by their own goroutine.
+// The events of a control uri that do not fit wait in overflow, which grows without bound.
+type eventQueue struct {
+	events     chan *Header
+	dispatched int64
+	dropped    int64
+	failed     int64
+
+	mu       sync.Mutex
+	overflow []*Header
+}
+
+// eventDispatcher hands the events read from the sidecar to the client away from the reader and the writer,
+// so that a slow handler neither delays requests nor stops replies from being read. Each event uri has
+// its own bounded queue, a full queue is dealt with according to policy: QueueDropOldest, the default,
+// drops the oldest event, QueueFailFast the new one, and QueueBlock holds the reader, replies included.
+// The control events are exempt, they neither drop nor block.
+type eventDispatcher struct {
+	ctx    context.Context
+	lg     *zap.Logger
+	size   int
+	policy QueuePolicy
+	handle func(h *Header) error
+
+	mu     sync.Mutex
+	queues map[int32]*eventQueue
+}
+
+func newEventDispatcher(ctx context.Context, lg *zap.Logger, size int, policy QueuePolicy, handle func(h *Header) error) *eventDispatcher {
+	return &eventDispatcher{ctx: ctx, lg: lg, size: size, policy: policy, handle: handle, queues: make(map[int32]*eventQueue)}
+}
+
+func (d *eventDispatcher) queue(uri int32) *eventQueue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q, ok := d.queues[uri]
+	if !ok {
+		q = &eventQueue{events: make(chan *Header, d.size)}
+		d.queues[uri] = q
+		go d.run(q)
+	}
+	return q
+}
+
+// push queues an event, it only blocks with QueueBlock on a full queue.
+func (d *eventDispatcher) push(h *Header) {
+	q := d.queue(h.Uri)
+	if controlEvents[h.Uri] {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		// once events overflow, the later ones queue behind them to stay in order
+		if len(q.overflow) == 0 {
+			select {
+			case q.events <- h:
+				return
+			default:
+			}
+		}
+		q.overflow = append(q.overflow, h)
+		return
+	}
+	select {
+	case q.events <- h:
+		return
+	default:
+	}
+	switch d.policy {
+	case QueueBlock:
+		select {
+		case q.events <- h:
+		case <-d.ctx.Done():
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case q.events <- h:
+				return
+			case <-q.events:
+				d.drop(q, h.Uri)
+			}
+		}
+	default:
+		d.drop(q, h.Uri)
+	}
+}
+
+func (d *eventDispatcher) drop(q *eventQueue, uri int32) {
+	if count := atomic.AddInt64(&q.dropped, 1); count&(count-1) == 0 {
+		// powers of two only, a flood of events must not flood the log as well
+		d.lg.Warn("event queue is full, drop event", zap.Int32("uri", uri), zap.Int64("dropped", count))
+	}
+}
+
+func (d *eventDispatcher) run(q *eventQueue) {
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case h := <-q.events:
+			q.refill()
+			if err := d.handle(h); err != nil {
+				atomic.AddInt64(&q.failed, 1)
+				d.lg.Error("Failed to handle event", zap.Int32("uri", h.Uri), zap.Error(err))
+				continue
+			}
+			atomic.AddInt64(&q.dispatched, 1)
+		}
+	}
+}
+
+// refill moves the overflow into the room left in the queue, run calls it after each event so that
+// the queue never runs dry while events overflow.
+func (q *eventQueue) refill() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.overflow) != 0 {
+		select {
+		case q.events <- q.overflow[0]:
+			q.overflow[0] = nil
+			q.overflow = q.overflow[1:]
+		default:
+			return
+		}
+	}
+}
+
+func (q *eventQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events) + len(q.overflow)
+}
+
+func (d *eventDispatcher) Stats() EventStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := EventStats{ByUri: make(map[int32]EventQueueStats, len(d.queues))}
+	for uri, q := range d.queues {
+		s := EventQueueStats{
+			Dispatched: atomic.LoadInt64(&q.dispatched),
+			Dropped:    atomic.LoadInt64(&q.dropped),
+			Failed:     atomic.LoadInt64(&q.failed),
+			QueueDepth: q.depth(),
+		}
+		stats.ByUri[uri] = s
+		stats.add(s)
+	}
+	return stats
+}
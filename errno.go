@@ -1,7 +1,21 @@
 package rtm2_sdk
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/tomasliu-agora/rtm2"
+)
+
+// Error codes of the failures detected by the SDK itself, the sidecar codes are the ones of rtm2.
+const (
+	ErrCodeOK           = 0
+	ErrCodeUnsupported  = 994
+	ErrCodeCanceled     = 995
+	ErrCodeUnknown      = 996
+	ErrCodeQueueFull    = 997
+	ErrCodeDisconnected = 998
+	ErrCodeTimeout      = 999
 )
 
 type RTMError struct {
@@ -13,11 +27,211 @@ func (e RTMError) Error() string {
 	return fmt.Sprintf("%d: %s", e.errno, e.msg)
 }
 
+// ErrCode returns the code of the error.
+func (e RTMError) ErrCode() int32 {
+	return int32(e.errno)
+}
+
+// Is matches any error carrying the same code, so that errors.Is(err, ERR_TIMEOUT) holds for a wrapped timeout.
+func (e RTMError) Is(target error) bool {
+	t, ok := target.(RTMError)
+	return ok && t.errno == e.errno
+}
+
 func newSDKError(errno int, msg string) error {
 	return RTMError{errno: errno, msg: msg}
 }
 
 var (
-	ERR_DISCONNECTED = newSDKError(998, "ERR_SDK_DISCONNECTED")
-	ERR_TIMEOUT      = newSDKError(999, "ERR_SDK_TIMEOUT")
+	ErrQueueFull     = newSDKError(ErrCodeQueueFull, "ERR_SDK_QUEUE_FULL")
+	ERR_DISCONNECTED = newSDKError(ErrCodeDisconnected, "ERR_SDK_DISCONNECTED")
+	ERR_TIMEOUT      = newSDKError(ErrCodeTimeout, "ERR_SDK_TIMEOUT")
+
+	ErrUnsupportedRequest = newSDKError(ErrCodeUnsupported, "ERR_SDK_UNSUPPORTED_REQUEST")
 )
+
+// UnsupportedRequestError rejects a request whose type has no uri, see RegisterRequest. It is never sent,
+// errors.Is(err, ErrUnsupportedRequest) holds for it.
+type UnsupportedRequestError struct {
+	Type string // the Go type of the request, such as *base.PresenceWhoNowReq
+}
+
+func (e *UnsupportedRequestError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrUnsupportedRequest, e.Type)
+}
+
+func (e *UnsupportedRequestError) Unwrap() error {
+	return ErrUnsupportedRequest
+}
+
+func newUnsupportedRequestError(req interface{}) error {
+	return &UnsupportedRequestError{Type: fmt.Sprintf("%T", req)}
+}
+
+// RequestError is the failure of one request to the sidecar. It keeps the uri and the seqId of the request
+// for diagnostics, Err is the sentinel it wraps, one of the SDK errors or of the rtm2 ones.
+type RequestError struct {
+	Uri      int32
+	SeqId    int64 // of the last attempt, zero if the request never got one
+	Code     int32
+	Attempts int // times the request was sent, more than one when the retry policy allows it
+	Err      error
+	Reply    *RawResponse // the body of an error reply, nil when the sidecar sent none
+}
+
+func (e *RequestError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("uri %d seqid %d: %v after %d attempts", e.Uri, e.SeqId, e.Err, e.Attempts)
+	}
+	return fmt.Sprintf("uri %d seqid %d: %v", e.Uri, e.SeqId, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RequestError) ErrCode() int32 {
+	return e.Code
+}
+
+func newRequestError(uri int32, seqId int64, err error) error {
+	if err == nil {
+		return nil
+	}
+	var re *RequestError
+	if errors.As(err, &re) {
+		return err
+	}
+	return &RequestError{Uri: uri, SeqId: seqId, Code: ErrCode(err), Attempts: 1, Err: err}
+}
+
+// ProtocolError reports a frame from the sidecar that cannot be decoded, the link is reset when it happens.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Reason
+}
+
+func newProtocolError(format string, args ...interface{}) error {
+	return &ProtocolError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// errorFromCode maps the error code of a reply to an error, local SDK codes first then the rtm2 ones.
+func errorFromCode(errno int32) error {
+	switch errno {
+	case ErrCodeUnsupported:
+		return ErrUnsupportedRequest
+	case ErrCodeQueueFull:
+		return ErrQueueFull
+	case ErrCodeDisconnected:
+		return ERR_DISCONNECTED
+	case ErrCodeTimeout:
+		return ERR_TIMEOUT
+	}
+	return rtm2.ErrorFromCode(errno)
+}
+
+// rtm2Codes recovers the code of the rtm2 sentinels, which keep it unexported.
+var rtm2Codes = func() map[rtm2.RTMError]int32 {
+	ranges := [][2]int32{{10001, 10015}, {10101, 10110}, {10201, 10202}, {10301, 10311}}
+	codes := make(map[rtm2.RTMError]int32)
+	for _, r := range ranges {
+		for code := r[0]; code <= r[1]; code++ {
+			if e, ok := rtm2.ErrorFromCode(code).(rtm2.RTMError); ok {
+				codes[e] = code
+			}
+		}
+	}
+	return codes
+}()
+
+// knownCode reports a code of the SDK or of rtm2, a sidecar replying with another one is likely older than the SDK.
+func knownCode(code int32) bool {
+	switch code {
+	case ErrCodeUnsupported, ErrCodeCanceled, ErrCodeUnknown, ErrCodeQueueFull, ErrCodeDisconnected, ErrCodeTimeout:
+		return true
+	}
+	if e, ok := rtm2.ErrorFromCode(code).(rtm2.RTMError); ok {
+		_, known := rtm2Codes[e]
+		return known
+	}
+	return false
+}
+
+// ErrCode returns the code carried by err: ErrCodeOK for nil, the sidecar or SDK code when known,
+// ErrCodeUnknown otherwise.
+func ErrCode(err error) int32 {
+	if err == nil {
+		return ErrCodeOK
+	}
+	var coded interface{ ErrCode() int32 }
+	if errors.As(err, &coded) {
+		return coded.ErrCode()
+	}
+	var rtmErr rtm2.RTMError
+	if errors.As(err, &rtmErr) {
+		if code, ok := rtm2Codes[rtmErr]; ok {
+			return code
+		}
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrCodeTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrCodeCanceled
+	}
+	return ErrCodeUnknown
+}
+
+func hasCode(err error, codes ...int32) bool {
+	code := ErrCode(err)
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRetryable reports a transient failure, the same request may succeed later.
+func IsRetryable(err error) bool {
+	return hasCode(err, ErrCodeTimeout, ErrCodeDisconnected, ErrCodeQueueFull,
+		10201, // ERR_LOCK_OPERATION_PERFORMING
+		10301, // ERR_PRESENCE_SERVICE_NOT_READY
+	)
+}
+
+// IsAuthError reports a failure of the login state or token, a new login or token is needed.
+func IsAuthError(err error) bool {
+	return hasCode(err,
+		10010, // ERR_ALREADY_LOGIN
+		10011, // ERR_NOT_LOGIN
+		10012, // ERR_DUPLICATE_TOKEN
+	)
+}
+
+// IsRateLimited reports a request refused because a limit is reached, locally or by the service.
+func IsRateLimited(err error) bool {
+	return hasCode(err, ErrCodeQueueFull,
+		10002, // ERR_EXCEED_JOIN_TOPIC_LIMITATION
+		10005, // ERR_EXCEED_SUBSCRIBE_TOPIC_LIMITATION
+		10006, // ERR_EXCEED_USER_LIMITATION
+		10007, // ERR_EXCEED_CHANNEL_LIMITATION
+		10109, // ERR_METADATA_EXCEED_SUBSCRIPTION_LIMIT
+		10310, // ERR_PRESENCE_CHANNEL_COUNT_OVERFLOW
+	)
+}
+
+// IsNotFound reports a request about a channel, subscription, lock or user that does not exist.
+func IsNotFound(err error) bool {
+	return hasCode(err,
+		10009, // ERR_NOT_JOIN_CHANNEL
+		10013, // ERR_NOT_SUBSCRIBED
+		10107, // ERR_METADATA_NOT_SUBSCRIBED
+		10202, // ERR_RELEASE_LOCK_NOT_ACQUIRED
+		10309, // ERR_PRESENCE_USER_NOT_EXIST
+		10311, // ERR_PRESENCE_CHANNEL_NOT_EXIST
+	)
+}
@@ -0,0 +1,245 @@
+package rtm2_sdk
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tevino/abool/v2"
+	"go.uber.org/zap"
+)
+
+// fakeSidecar speaks the frame format over tcp, replies come from reply, nil leaves a request unanswered.
+type fakeSidecar struct {
+	ln       net.Listener
+	reply    func(h *Header) *Header
+	drop     abool.AtomicBool // close every link as soon as it is accepted
+	accepted int32
+
+	mu       sync.Mutex
+	conns    map[net.Conn]*sync.Mutex
+	received []*Header
+}
+
+func newFakeSidecar(t *testing.T, reply func(h *Header) *Header) *fakeSidecar {
+	return listenFakeSidecar(t, "127.0.0.1:0", reply)
+}
+
+func listenFakeSidecar(t *testing.T, addr string, reply func(h *Header) *Header) *fakeSidecar {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSidecar{ln: ln, reply: reply, conns: make(map[net.Conn]*sync.Mutex)}
+	t.Cleanup(s.close)
+	go s.accept()
+	return s
+}
+
+// echo answers every request with an empty reply.
+func echo(h *Header) *Header {
+	return &Header{Uri: h.Uri, SeqId: h.SeqId, ConnIndex: h.ConnIndex}
+}
+
+func (s *fakeSidecar) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeSidecar) close() {
+	_ = s.ln.Close()
+	s.disconnect()
+}
+
+// disconnect drops every link, new ones are still accepted.
+func (s *fakeSidecar) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+func (s *fakeSidecar) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.accepted, 1)
+		if s.drop.IsSet() {
+			_ = conn.Close()
+			continue
+		}
+		wmu := &sync.Mutex{}
+		s.mu.Lock()
+		s.conns[conn] = wmu
+		s.mu.Unlock()
+		go s.serve(conn, wmu)
+	}
+}
+
+func (s *fakeSidecar) serve(conn net.Conn, wmu *sync.Mutex) {
+	reader := bufio.NewReader(conn)
+	for {
+		h, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received = append(s.received, h)
+		s.mu.Unlock()
+		if s.reply == nil {
+			continue
+		}
+		if resp := s.reply(h); resp != nil {
+			_ = s.write(conn, wmu, resp)
+		}
+	}
+}
+
+func (s *fakeSidecar) write(conn net.Conn, wmu *sync.Mutex, headers ...*Header) error {
+	var buffer []byte
+	for _, h := range headers {
+		buffer = append(buffer, encodeTestFrame(h)...)
+	}
+	wmu.Lock()
+	defer wmu.Unlock()
+	_, err := conn.Write(buffer)
+	return err
+}
+
+// push writes headers to every link in a single write, so that they arrive in one buffer.
+func (s *fakeSidecar) push(headers ...*Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, wmu := range s.conns {
+		_ = s.write(conn, wmu, headers...)
+	}
+}
+
+// pushTo writes headers to the link of c only.
+func (s *fakeSidecar) pushTo(c *connection, headers ...*Header) {
+	conn, _ := c.current()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for link, wmu := range s.conns {
+		if link.RemoteAddr().String() == conn.LocalAddr().String() {
+			_ = s.write(link, wmu, headers...)
+		}
+	}
+}
+
+func (s *fakeSidecar) requests() []*Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Header(nil), s.received...)
+}
+
+func encodeTestFrame(h *Header) []byte {
+	size := h.Size()
+	buffer := make([]byte, FrameSize(size))
+	if err := EncodeFrame(buffer, serviceSubproxy, UriCommonResp, h, size); err != nil {
+		panic(err)
+	}
+	return buffer
+}
+
+func readFrame(reader *bufio.Reader) (*Header, error) {
+	prefix, err := reader.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[1]&0x80 != 0 {
+		if prefix, err = reader.Peek(3); err != nil {
+			return nil, err
+		}
+	}
+	length, lenSize, err := DecodeFrameLen(prefix)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, length)
+	if _, err = io.ReadFull(reader, frame); err != nil {
+		return nil, err
+	}
+	_, _, content, err := DecodeFrame(frame, lenSize)
+	if err != nil {
+		return nil, err
+	}
+	h := &Header{}
+	return h, h.Unmarshal(content)
+}
+
+// events collects what a connection hands to its callback.
+type events struct {
+	ch chan *Header
+}
+
+func newEvents() *events {
+	return &events{ch: make(chan *Header, 1024)}
+}
+
+func (e *events) onResponse(uri int32, errCode int32, message []byte) error {
+	e.ch <- &Header{Uri: uri, ErrCode: errCode, Message: message}
+	return nil
+}
+
+func startConnection(t *testing.T, edp string, config *connectionConfig, callback connectionCallback) *connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	if callback == nil {
+		callback = newEvents()
+	}
+	c := NewConnection(ctx, zap.NewNop(), edp, config, callback)
+	c.Start()
+	t.Cleanup(cancel)
+	return c
+}
+
+// roundTrip sends a request of uri on c and waits for its reply.
+func roundTrip(t *testing.T, c *connection, uri int32, timeout time.Duration) (*Header, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	rc := make(chan *Header, 1)
+	h := &Header{Uri: uri}
+	if err := c.SendRequest(ctx, h, rc); err != nil {
+		return nil, err
+	}
+	select {
+	case resp, ok := <-rc:
+		if !ok {
+			return nil, ERR_DISCONNECTED
+		}
+		return resp, nil
+	case <-ctx.Done():
+		c.CancelRequest(h.SeqId)
+		return nil, ERR_TIMEOUT
+	}
+}
+
+// waitFor polls cond until it holds or the timeout elapses.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startInvoker returns an invoker linked to edp, as PreLogin does for golang_sidecar_endpoint.
+func startInvoker(t *testing.T, edp string) *rtmInvoker {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	i := &rtmInvoker{ctx: ctx, cancel: cancel, lg: zap.NewNop(), timeouts: newRequestTimeouts(), retries: newRetryPolicy(), session: newSession()}
+	i.conn = newConnectionPool(ctx, i.lg, edp, 1, nil, i)
+	i.conn.Start()
+	return i
+}
@@ -1,6 +1,6 @@
 module github.com/tomasliu-agora/rtm2-sdk
 
-go 1.17
+go 1.18
 
 require (
 	github.com/cloudwego/netpoll v0.2.4
@@ -9,12 +9,13 @@ require (
 	github.com/tomasliu-agora/rtm2 v0.0.2-0.20230414075759-bbc41c544f7a
 	github.com/tomasliu-agora/rtm2-base v0.0.0-20230416090455-1d6c8f3ba61e
 	go.uber.org/zap v1.24.0
+	golang.org/x/sys v0.0.0-20220110181412-a018aaa089fe
+	google.golang.org/protobuf v1.28.1
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
 
 require (
 	github.com/bytedance/gopkg v0.0.0-20220413063733-65bf48ffb3a7 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
-	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
 )
@@ -0,0 +1,150 @@
+package rtm2_sdk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tomasliu-agora/rtm2"
+	"go.uber.org/zap"
+)
+
+// The test binary doubles as a fake sidecar: spawned with helperSidecarEnv set, it serves the frame format
+// on the endpoint given by --port or --socket, answering every request with an empty reply.
+const (
+	helperSidecarEnv = "RTM2_SDK_HELPER_SIDECAR"
+	// file the fake sidecar appends "<pid> <uri>" to for each request
+	helperLogEnv = "RTM2_SDK_HELPER_LOG"
+	// marker file: while it does not exist, the fake sidecar creates it with its port and exits without
+	// listening, as a sidecar failing to bind does
+	helperFailFirstEnv = "RTM2_SDK_HELPER_FAIL_FIRST"
+	// set, the fake sidecar rejects --socket as a wrapper without unix socket support would
+	helperNoSocketEnv = "RTM2_SDK_HELPER_NO_SOCKET"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(helperSidecarEnv) != "" {
+		os.Exit(runHelperSidecar(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+func runHelperSidecar(args []string) int {
+	var network, address, port string
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--port="):
+			port = strings.TrimPrefix(arg, "--port=")
+			network, address = "tcp", "127.0.0.1:"+port
+		case strings.HasPrefix(arg, "--socket="):
+			if os.Getenv(helperNoSocketEnv) != "" {
+				fmt.Fprintf(os.Stderr, "unknown option %s\n", arg)
+				return 2
+			}
+			network, address = "unix", strings.TrimPrefix(arg, "--socket=")
+		}
+	}
+	if network == "" {
+		fmt.Fprintln(os.Stderr, "no endpoint given")
+		return 2
+	}
+	if marker := os.Getenv(helperFailFirstEnv); marker != "" {
+		if _, err := os.Stat(marker); os.IsNotExist(err) {
+			_ = os.WriteFile(marker, []byte(port), 0o600)
+			fmt.Fprintf(os.Stderr, "failed to bind %s\n", address)
+			return 1
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var mu sync.Mutex
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return 1
+		}
+		go func() {
+			reader := bufio.NewReader(conn)
+			for {
+				h, err := readFrame(reader)
+				if err != nil {
+					return
+				}
+				if log := os.Getenv(helperLogEnv); log != "" {
+					mu.Lock()
+					if f, err := os.OpenFile(log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600); err == nil {
+						fmt.Fprintf(f, "%d %d\n", os.Getpid(), h.Uri)
+						_ = f.Close()
+					}
+					mu.Unlock()
+				}
+				if _, err := conn.Write(encodeTestFrame(echo(h))); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// helperParams spawns the fake sidecar with env, restarting it without delay.
+func helperParams(t *testing.T, env map[string]string) map[string]interface{} {
+	binary, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecarEnv := map[string]string{helperSidecarEnv: "1"}
+	for key, value := range env {
+		sidecarEnv[key] = value
+	}
+	return map[string]interface{}{
+		kParamSidecarBinary:         binary,
+		kParamSidecarEnv:            sidecarEnv,
+		kParamSidecarRestartBackoff: int32(10),
+		kParamSidecarStopGrace:      int32(1000),
+	}
+}
+
+func newClient(params map[string]interface{}) (*rtm2Client, chan error) {
+	errChan := make(chan error, 10)
+	client := CreateRTM2Client(context.Background(), rtm2.RTMConfig{Appid: "app", UserId: "user", Logger: zap.NewNop()}, errChan).(*rtm2Client)
+	client.SetParameters(params)
+	return client, errChan
+}
+
+// loginClient logs a client in with params, on a fake sidecar spawned or given by an endpoint.
+func loginClient(t *testing.T, params map[string]interface{}) (*rtm2Client, chan error) {
+	client, errChan := newClient(params)
+	if _, _, err := client.Login("token"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	return client, errChan
+}
+
+// helperRequests reads the uris the fake sidecars logged, by pid.
+func helperRequests(t *testing.T, log string) map[int][]int32 {
+	content, err := os.ReadFile(log)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	ret := make(map[int][]int32)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		pid, _ := strconv.Atoi(fields[0])
+		uri, _ := strconv.Atoi(fields[1])
+		ret[pid] = append(ret[pid], int32(uri))
+	}
+	return ret
+}
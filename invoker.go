@@ -4,12 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/tevino/abool/v2"
 	"github.com/tomasliu-agora/rtm2"
 	base "github.com/tomasliu-agora/rtm2-base"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,7 +22,19 @@ type rtmInvoker struct {
 
 	callback base.InvokeCallback
 	sidecar  *rtmSidecar
-	conn     *connection
+	conn     *connectionPool
+	shared   *sharedSidecar
+	index    uint64
+	timeouts *requestTimeouts
+	// set once the sidecar is known not to list subscribed users, or by kParamSubListLocal
+	localSubList abool.AtomicBool
+	// the uri listing subscribed users on the sidecar, kParamSubListUri, 0 until the sidecar has one
+	subListUri int32
+	// consecutive timeouts of subListUri
+	subListTimeouts int32
+	retries         *retryPolicy
+	session         *session
+	raw             sync.Map // uri -> RawEventHandler
 
 	errorChan chan<- error
 
@@ -27,144 +42,205 @@ type rtmInvoker struct {
 	cli rtm2.RTMClient
 }
 
+// onResponse decodes an event into the type registered for uri and hands it to the client.
 func (i *rtmInvoker) onResponse(uri int32, errCode int32, message []byte) error {
-	switch uri {
-	case UriConnectStateChange:
-		event := &base.ConnectionStateChangeEvent{}
-		err := event.Unmarshal(message)
-		if err != nil {
-			i.lg.Error("Failed to unmarshal", zap.Error(err))
-			return err
-		}
-		i.callback.OnEvent(event)
-	case UriMessageEvent:
-		event := &base.MessageEvent{}
-		err := event.Unmarshal(message)
-		if err != nil {
-			i.lg.Error("Failed to unmarshal", zap.Error(err))
-			return err
-		}
-		i.callback.OnEvent(event)
-	case UriStreamEvent:
-		event := &base.StreamMessageEvent{}
-		err := event.Unmarshal(message)
-		if err != nil {
-			i.lg.Error("Failed to unmarshal", zap.Error(err))
-			return err
-		}
-		i.callback.OnEvent(event)
-	case UriStreamTopicEvent:
-		event := &base.StreamTopicEvent{}
-		err := event.Unmarshal(message)
-		if err != nil {
-			i.lg.Error("Failed to unmarshal", zap.Error(err))
-			return err
-		}
-		i.callback.OnEvent(event)
-	case UriStorageChannelEvent:
-		event := &base.StorageChannelEvent{}
-		err := event.Unmarshal(message)
-		if err != nil {
-			i.lg.Error("Failed to unmarshal", zap.Error(err))
-			return err
-		}
-		i.callback.OnEvent(event)
-	case UriStorageUserEvent:
-		event := &base.StorageUserEvent{}
-		err := event.Unmarshal(message)
-		if err != nil {
-			i.lg.Error("Failed to unmarshal", zap.Error(err))
-			return err
-		}
-		i.callback.OnEvent(event)
-	case UriPresenceEvent:
-		event := &base.PresenceEvent{}
-		err := event.Unmarshal(message)
-		if err != nil {
-			i.lg.Error("Failed to unmarshal", zap.Error(err))
-			return err
-		}
-		i.callback.OnEvent(event)
-	case UriLockEvent:
-		event := &base.LockEvent{}
-		err := event.Unmarshal(message)
-		if err != nil {
-			i.lg.Error("Failed to unmarshal", zap.Error(err))
-			return err
-		}
-		i.callback.OnEvent(event)
-	case UriTokenPrivilegeExpire:
-		event := &base.TokenPrivilegeExpire{}
-		err := event.Unmarshal(message)
-		if err != nil {
-			i.lg.Error("Failed to unmarshal", zap.Error(err))
-			return err
-		}
-		i.callback.OnEvent(event)
-	default:
+	op := registry.operation(uri)
+	if op != nil && op.newEvent == nil && op.raw {
+		return i.onRawEvent(uri, errCode, message)
+	}
+	if op == nil || op.newEvent == nil {
 		i.lg.Warn("unknown event", zap.Int32("uri", uri), zap.Int32("errCode", errCode))
+		return nil
 	}
+	event := op.newEvent()
+	if err := event.Unmarshal(message); err != nil {
+		i.lg.Error("Failed to unmarshal", zap.Error(err))
+		return err
+	}
+	i.callback.OnEvent(event)
 	return nil
 }
 
 func (i *rtmInvoker) OnReceived(req interface{}) (interface{}, int32, error) {
-	rc := make(chan *Header, 1)
+	return i.OnReceivedContext(i.ctx, req)
+}
+
+// OnReceivedContext sends req and waits for its reply, giving up when ctx is done or the uri's timeout elapses.
+// Requests the retry policy allows are sent again on transient failures, each attempt with its own timeout.
+func (i *rtmInvoker) OnReceivedContext(ctx context.Context, req interface{}) (interface{}, int32, error) {
+	if r, ok := req.(*base.StreamSubListReq); ok {
+		return i.getSubscribedUsers(ctx, r)
+	}
 	uri := getUriFromReq(req)
 	if uri == invalidUri {
-		return nil, 0, errors.New("unknown error")
+		return nil, ErrCodeUnsupported, newUnsupportedRequestError(req)
 	}
-	err := i.conn.SendRequest(generateHeader(uri, req.(Marshalable)), rc)
+	return i.call(ctx, uri, req)
+}
+
+// call sends req, retrying it as the policy allows, and decodes the reply.
+func (i *rtmInvoker) call(ctx context.Context, uri int32, req interface{}) (interface{}, int32, error) {
+	h, err := i.send(ctx, uri, req)
 	if err != nil {
-		return nil, 0, err
+		return nil, ErrCode(err), err
+	}
+	resp, errCode, err := i.decode(uri, h)
+	if err == nil {
+		i.session.record(req, resp)
 	}
-	resp, err := i.receive(rc)
+	return resp, errCode, err
+}
+
+// send sends req until it is answered or the retry policy gives up.
+func (i *rtmInvoker) send(ctx context.Context, uri int32, req interface{}) (*Header, error) {
+	var resp *Header
+	for attempt := 1; ; attempt++ {
+		var err error
+		if resp, err = i.invoke(ctx, uri, req); err == nil {
+			break
+		}
+		var reqErr *RequestError
+		if errors.As(err, &reqErr) {
+			reqErr.Attempts = attempt
+		}
+		if !i.retries.allows(uri, err, attempt) || ctx.Err() != nil {
+			return nil, err
+		}
+		delay := i.retries.backoff.delay(attempt)
+		i.lg.Warn("request failed, retry later", zap.Int32("uri", uri), zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+	return resp, nil
+}
+
+// decode turns the reply to uri into its response, a body that cannot be decoded fails the request.
+func (i *rtmInvoker) decode(uri int32, h *Header) (interface{}, int32, error) {
+	resp, errCode, err := unmarshalResp(uri, h.ErrCode, h.Message)
 	if err != nil {
-		return nil, 999, err
-	} else if len(resp.Message) != 0 {
-		return unmarshalResp(uri, resp.ErrCode, resp.Message)
-	} else {
-		return nil, resp.ErrCode, nil
+		i.lg.Error("Failed to decode reply", zap.Int32("uri", uri), zap.Int64("seqid", h.SeqId), zap.Error(err))
+		return nil, errCode, newRequestError(uri, h.SeqId, err)
 	}
+	return resp, errCode, nil
+}
+
+// maxSubListTimeouts is how many timeouts in a row make a sidecar taken for one not listing subscribed users.
+const maxSubListTimeouts = 3
+
+// getSubscribedUsers answers from the session journal, the sidecar has no operation listing subscribed users yet.
+// With kParamSubListUri the sidecar is asked instead, an empty body being an empty list. A code unknown to rtm2
+// means it does not support the uri, from then on the session journal answers again. A timeout is answered
+// from the journal as well, but only maxSubListTimeouts in a row stop asking the sidecar.
+func (i *rtmInvoker) getSubscribedUsers(ctx context.Context, req *base.StreamSubListReq) (interface{}, int32, error) {
+	if uri := i.subListUri; uri != 0 && !i.localSubList.IsSet() {
+		resp, err := i.send(ctx, uri, req)
+		if err == nil {
+			atomic.StoreInt32(&i.subListTimeouts, 0)
+			users := &base.StreamSubListResp{}
+			if err = users.Unmarshal(resp.Message); err != nil {
+				i.lg.Error("Failed to decode reply", zap.Int32("uri", uri), zap.Int64("seqid", resp.SeqId), zap.Error(err))
+				return nil, ErrCodeUnknown, newRequestError(uri, resp.SeqId, err)
+			}
+			return users, 0, nil
+		}
+		switch code := ErrCode(err); {
+		case code == ErrCodeTimeout:
+			if timeouts := atomic.AddInt32(&i.subListTimeouts, 1); timeouts >= maxSubListTimeouts {
+				i.lg.Info("sidecar does not answer listing subscribed users, answer from the session", zap.Int32("uri", uri), zap.Int32("timeouts", timeouts))
+				i.localSubList.Set()
+			} else {
+				i.lg.Warn("timeout listing subscribed users, answer from the session", zap.Int32("uri", uri), zap.Int32("timeouts", timeouts))
+			}
+		case code == ErrCodeUnsupported || !knownCode(code):
+			i.lg.Info("sidecar does not list subscribed users, answer from the session", zap.Int32("uri", uri), zap.Error(err))
+			i.localSubList.Set()
+		default:
+			return nil, code, err
+		}
+	}
+	users := i.session.subscribedUsers(req.Channel, req.Topic)
+	return &base.StreamSubListResp{Channel: req.Channel, Topic: req.Topic, UserIds: users}, 0, nil
+}
+
+// invoke makes one attempt at req.
+func (i *rtmInvoker) invoke(ctx context.Context, uri int32, req interface{}) (*Header, error) {
+	if i.conn == nil {
+		return nil, newRequestError(uri, 0, ERR_DISCONNECTED)
+	}
+	rc := make(chan *Header, 1)
+	ctx, cancel := context.WithTimeout(ctx, i.timeouts.of(uri))
+	defer cancel()
+	header := generateHeader(uri, req.(Marshalable))
+	header.ConnIndex = i.index
+	conn := i.conn.pick(req)
+	if err := conn.SendRequest(ctx, header, rc); err != nil {
+		return nil, newRequestError(uri, header.SeqId, err)
+	}
+	return i.receive(ctx, conn, uri, header.SeqId, rc)
 }
 
 func (i *rtmInvoker) OnAsyncReceived(req interface{}, callback func(interface{}, int32, error)) error {
 	rc := make(chan *Header, 1)
 	uri := getUriFromReq(req)
 	if uri == invalidUri {
-		return errors.New("unknown error")
+		return newUnsupportedRequestError(req)
+	}
+	if i.conn == nil {
+		return newRequestError(uri, 0, ERR_DISCONNECTED)
 	}
-	err := i.conn.SendRequest(generateHeader(uri, req.(Marshalable)), rc)
+	ctx, cancel := context.WithTimeout(i.ctx, i.timeouts.of(uri))
+	header := generateHeader(uri, req.(Marshalable))
+	header.ConnIndex = i.index
+	conn := i.conn.pick(req)
+	err := conn.SendRequest(ctx, header, rc)
 	if err != nil {
-		return err
+		cancel()
+		return newRequestError(uri, header.SeqId, err)
 	}
 	go func() {
-		resp, rErr := i.receive(rc)
+		defer cancel()
+		resp, rErr := i.receive(ctx, conn, uri, header.SeqId, rc)
 		i.lg.Debug("on async recv", zap.Any("resp", resp))
 		if rErr != nil {
-			callback(nil, 0, rErr)
-		} else if len(resp.Message) != 0 {
-			respObj, errCode, mErr := unmarshalResp(uri, resp.ErrCode, resp.Message)
-			callback(respObj, errCode, mErr)
-		} else {
-			callback(nil, resp.ErrCode, nil)
+			callback(nil, ErrCode(rErr), rErr)
+			return
+		}
+		decoded, errCode, dErr := i.decode(uri, resp)
+		if dErr == nil {
+			i.session.record(req, decoded)
 		}
+		callback(decoded, errCode, dErr)
 	}()
 	return nil
 }
 
-func (i *rtmInvoker) receive(rc <-chan *Header) (*Header, error) {
+// receive waits for the reply of seqId sent on conn, ctx carries the request timeout.
+// Failures are returned as a *RequestError.
+func (i *rtmInvoker) receive(ctx context.Context, conn *connection, uri int32, seqId int64, rc <-chan *Header) (*Header, error) {
 	select {
 	case h, ok := <-rc:
 		if !ok {
-			return nil, ERR_DISCONNECTED
+			return nil, newRequestError(uri, seqId, ERR_DISCONNECTED)
 		}
 		if h.ErrCode != 0 {
-			return nil, rtm2.ErrorFromCode(h.ErrCode)
+			err := &RequestError{Uri: uri, SeqId: seqId, Code: h.ErrCode, Attempts: 1, Err: errorFromCode(h.ErrCode)}
+			if len(h.Message) != 0 {
+				err.Reply = &RawResponse{Uri: uri, ErrCode: h.ErrCode, Message: h.Message}
+			}
+			return nil, err
 		}
 		return h, nil
-	case <-time.After(time.Second * 5):
-		i.lg.Info("timeout")
-		return nil, ERR_TIMEOUT
+	case <-ctx.Done():
+		conn.CancelRequest(seqId)
+		if ctx.Err() == context.DeadlineExceeded {
+			i.lg.Info("timeout", zap.Int32("uri", uri), zap.Int64("seqid", seqId))
+			return nil, newRequestError(uri, seqId, ERR_TIMEOUT)
+		}
+		i.lg.Info("request canceled", zap.Int32("uri", uri), zap.Int64("seqid", seqId))
+		return nil, newRequestError(uri, seqId, ctx.Err())
 	}
 }
 
@@ -174,29 +250,45 @@ func (i *rtmInvoker) SetCallback(callback base.InvokeCallback) {
 
 func (i *rtmInvoker) PreLogin() {
 	params := i.cli.GetParameters()
-	if value, ok := params[kParamSidecarEndpoint]; ok {
+	i.timeouts.apply(params)
+	i.retries.apply(params)
+	if local, ok := params[kParamSubListLocal].(bool); ok && local {
+		i.localSubList.Set()
+	}
+	i.subListUri = paramInt32(params, kParamSubListUri, 0)
+	if group, ok := params[kParamSidecarShared].(string); ok && group != "" {
+		shared, index, err := acquireShared(group, i, params)
+		if err != nil {
+			i.lg.Error("failed to create shared sidecar", zap.Error(err))
+			i.report(err)
+			return
+		}
+		i.shared, i.index, i.conn = shared, index, shared.conn
+		// a client dropped without logging out still leaves the group
+		go func() {
+			<-i.ctx.Done()
+			shared.release(index)
+		}()
+	} else if value, ok := params[kParamSidecarEndpoint]; ok {
 		endpoint := value.(string)
-		i.conn = NewConnection(i.ctx, i.lg, endpoint, i)
+		i.conn = newConnectionPool(i.ctx, i.lg, endpoint, connectionsFromParams(params), connectionConfigFromParams(params), i)
+		go i.watch()
 		i.conn.Start()
 	} else {
-		var (
-			port int32
-		)
-		if value, ok = params[kParamSidecarPort]; ok {
-			port, ok = value.(int32)
-			if !ok {
-				port = DefaultSidecarPort
-			}
-		} else {
-			port = DefaultSidecarPort
+		sidecar, err := createSidecar(i.ctx, i.lg, sidecarConfigFromParams(params))
+		if err != nil {
+			i.lg.Error("failed to create sidecar", zap.Error(err))
+			i.report(err)
+			return
 		}
-		execPath := "."
-		if p, ok := params[kParamSidecarPath]; ok {
-			execPath = p.(string)
+		i.sidecar = sidecar
+		errChan := i.sidecar.Start()
+		// dial only once the sidecar listens on the endpoint it was given, later generations are handled by loop
+		if _, err := i.sidecar.WaitReady(i.ctx); err != nil {
+			i.lg.Error("sidecar is not ready", zap.Error(err))
 		}
-		i.sidecar = createSidecar(i.ctx, i.lg, execPath, port)
-		i.conn = NewConnection(i.ctx, i.lg, fmt.Sprintf("127.0.0.1:%d", port), i)
-		go i.loop()
+		i.conn = newConnectionPool(i.ctx, i.lg, sidecar.Endpoint(), connectionsFromParams(params), spawnedConnectionConfig(params), i)
+		go i.loop(errChan)
 		i.conn.Start()
 	}
 }
@@ -207,18 +299,25 @@ func (i *rtmInvoker) PreLogout() {}
 
 func (i *rtmInvoker) PostLogout() {
 	i.cancel()
-	i.sidecar.Stop()
+	if i.shared != nil {
+		i.shared.release(i.index)
+		return
+	}
+	if err := i.sidecar.Stop(context.Background()); err != nil {
+		i.lg.Error("failed to stop sidecar", zap.Error(err))
+	}
 }
 
-func (i *rtmInvoker) loop() {
-	errChan := i.sidecar.Start()
+func (i *rtmInvoker) loop(errChan <-chan error) {
 	var err error
 	defer func() {
 		if err != nil {
 			i.errorChan <- err
 		}
 		i.cancel()
-		i.sidecar.Stop()
+		if err := i.sidecar.Stop(context.Background()); err != nil {
+			i.lg.Error("failed to stop sidecar", zap.Error(err))
+		}
 	}()
 	for {
 		select {
@@ -231,6 +330,54 @@ func (i *rtmInvoker) loop() {
 		case err = <-i.conn.ErrorChan():
 			i.lg.Info("connection error", zap.Error(err))
 			return
+		case gen := <-i.sidecar.Ready():
+			// a sidecar that failed to bind is restarted on another port
+			i.conn.SetEndpoint(i.sidecar.Endpoint())
+			i.conn.Redial()
+			if gen > 1 {
+				go i.restore(gen)
+			}
+		}
+	}
+}
+
+// watch restores the session each time the link to a sidecar given by golang_sidecar_endpoint is established
+// again: whoever runs that sidecar may have restarted it, and the SDK cannot tell a restart from a lost link.
+func (i *rtmInvoker) watch() {
+	for reconnects := 1; ; reconnects++ {
+		select {
+		case <-i.ctx.Done():
+			return
+		case <-i.conn.Reconnected():
+			i.restore(reconnects)
+		}
+	}
+}
+
+// report hands an error to the application without blocking when nobody listens.
+func (i *rtmInvoker) report(err error) {
+	select {
+	case i.errorChan <- err:
+	default:
+		i.lg.Warn("error channel is full, drop error", zap.Error(err))
+	}
+}
+
+// restore logs in again and re-establishes the subscriptions on a restarted sidecar, or a reconnected one
+// when gen counts reconnects. The requests are queued in order, they go out as soon as the connection is back.
+func (i *rtmInvoker) restore(gen int) {
+	reqs := i.session.replay()
+	i.lg.Info("restore session on restarted sidecar", zap.Int("generation", gen), zap.Int("requests", len(reqs)))
+	for idx, req := range reqs {
+		_, _, err := i.OnReceivedContext(i.ctx, req)
+		if err == nil {
+			continue
+		}
+		i.lg.Error("failed to restore session", zap.Int("generation", gen), zap.String("request", fmt.Sprintf("%T", req)), zap.Error(err))
+		if idx == 0 {
+			// without login the session is lost, report it like a fatal sidecar error
+			i.report(err)
+			return
 		}
 	}
 }
@@ -263,11 +410,11 @@ func initLogger(config *rtm2.RTMConfig) {
 	}
 }
 
-func CreateRTM2Client(ctx context.Context, config rtm2.RTMConfig, errChan chan<- error) rtm2.RTMClient {
+func CreateRTM2Client(ctx context.Context, config rtm2.RTMConfig, errChan chan<- error) RTM2Client {
 	c, cancel := context.WithCancel(ctx)
 	initLogger(&config)
-	inv := &rtmInvoker{ctx: c, cancel: cancel, sidecar: nil, lg: config.Logger, errorChan: errChan}
+	inv := &rtmInvoker{ctx: c, cancel: cancel, sidecar: nil, lg: config.Logger, errorChan: errChan, timeouts: newRequestTimeouts(), retries: newRetryPolicy(), session: newSession()}
 	cli := base.CreateRTMClient(ctx, config, inv)
 	inv.cli = cli
-	return cli
+	return &rtm2Client{RTMClient: cli, invoker: inv}
 }
@@ -0,0 +1,272 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tevino/abool/v2"
+	base "github.com/tomasliu-agora/rtm2-base"
+)
+
+func TestCallGivesUpWhenContextIsDone(t *testing.T) {
+	s := newFakeSidecar(t, nil) // never replies
+	i := startInvoker(t, s.addr())
+	client := &rtm2Client{invoker: i}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err := client.Call(ctx, &base.PresenceWhoNowReq{Channel: "ch"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned after %v, the cancellation did not reach the request", elapsed)
+	}
+	if pending := i.conn.conns[0].requests.len(); pending != 0 {
+		t.Fatalf("%d requests still pending", pending)
+	}
+}
+
+// subscribe records a subscription in the session of i, as a successful SubscribeTopic does.
+func subscribe(i *rtmInvoker, users ...string) {
+	i.session.record(&base.StreamSubTopicReq{Channel: "ch", Topic: "topic", UserIds: users},
+		&base.StreamSubTopicResp{Channel: "ch", Topic: "topic", Succeed: users})
+}
+
+func subscribedUsers(t *testing.T, i *rtmInvoker) []string {
+	t.Helper()
+	resp, _, err := i.OnReceivedContext(context.Background(), &base.StreamSubListReq{Channel: "ch", Topic: "topic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.(*base.StreamSubListResp).UserIds
+}
+
+func TestSubscribedUsersAreLocalByDefault(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	i := startInvoker(t, s.addr())
+	subscribe(i, "b", "a")
+
+	if users := subscribedUsers(t, i); len(users) != 2 || users[0] != "a" || users[1] != "b" {
+		t.Fatalf("got users %v, want [a b]", users)
+	}
+	if n := len(s.requests()); n != 0 {
+		t.Fatalf("the sidecar got %d requests", n)
+	}
+}
+
+func TestSubscribedUsersFromTheSidecar(t *testing.T) {
+	const uri = 99
+	s := newFakeSidecar(t, echo) // an empty body, nobody is subscribed
+	i := startInvoker(t, s.addr())
+	i.subListUri = uri
+	subscribe(i, "a")
+
+	for k := 0; k < 2; k++ {
+		if users := subscribedUsers(t, i); len(users) != 0 {
+			t.Fatalf("got users %v from an empty reply", users)
+		}
+	}
+	if i.localSubList.IsSet() {
+		t.Fatal("an empty reply made the sidecar unsupported")
+	}
+	if n := len(s.requests()); n != 2 || s.requests()[0].Uri != uri {
+		t.Fatalf("the sidecar got %d requests, want 2 of uri %d", n, uri)
+	}
+}
+
+func TestSubscribedUsersFallBackOnTimeout(t *testing.T) {
+	const uri = 99
+	s := newFakeSidecar(t, nil) // never replies
+	i := startInvoker(t, s.addr())
+	i.subListUri = uri
+	i.timeouts.uris[uri] = 50 * time.Millisecond
+	subscribe(i, "a")
+
+	// each timeout is answered from the session, the sidecar is asked until maxSubListTimeouts in a row
+	for k := 0; k < maxSubListTimeouts+2; k++ {
+		if users := subscribedUsers(t, i); len(users) != 1 || users[0] != "a" {
+			t.Fatalf("got users %v, want [a]", users)
+		}
+	}
+	if n := len(s.requests()); n != maxSubListTimeouts {
+		t.Fatalf("the sidecar got %d requests, want %d before falling back", n, maxSubListTimeouts)
+	}
+}
+
+func TestSubscribedUsersTimeoutsMustBeInARow(t *testing.T) {
+	const uri = 99
+	var answer abool.AtomicBool
+	s := newFakeSidecar(t, func(h *Header) *Header {
+		if answer.IsSet() {
+			return echo(h)
+		}
+		return nil
+	})
+	i := startInvoker(t, s.addr())
+	i.subListUri = uri
+	i.timeouts.uris[uri] = 50 * time.Millisecond
+
+	for k := 0; k < 3*maxSubListTimeouts; k++ {
+		// a sidecar slow now and then, answering in between
+		answer.SetTo(k%maxSubListTimeouts == maxSubListTimeouts-1)
+		subscribedUsers(t, i)
+	}
+	if i.localSubList.IsSet() {
+		t.Fatal("timeouts apart made the sidecar unsupported")
+	}
+}
+
+func TestSubscribedUsersFallBackOnUnsupported(t *testing.T) {
+	const uri = 99
+	s := newFakeSidecar(t, func(h *Header) *Header {
+		return &Header{Uri: h.Uri, SeqId: h.SeqId, ErrCode: ErrCodeUnsupported}
+	})
+	i := startInvoker(t, s.addr())
+	i.subListUri = uri
+	subscribe(i, "a")
+
+	for k := 0; k < 2; k++ {
+		if users := subscribedUsers(t, i); len(users) != 1 || users[0] != "a" {
+			t.Fatalf("got users %v, want [a]", users)
+		}
+	}
+	if n := len(s.requests()); n != 1 {
+		t.Fatalf("the sidecar got %d requests, want 1 before falling back", n)
+	}
+}
+
+func TestUnregisteredRequestIsNotSent(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	i := startInvoker(t, s.addr())
+
+	_, code, err := i.OnReceivedContext(context.Background(), &struct{ Channel string }{"ch"})
+	if !errors.Is(err, ErrUnsupportedRequest) || code != ErrCodeUnsupported {
+		t.Fatalf("got %d %v, want ErrUnsupportedRequest", code, err)
+	}
+	var unsupported *UnsupportedRequestError
+	if !errors.As(err, &unsupported) || unsupported.Type != "*struct { Channel string }" {
+		t.Fatalf("got %#v, want the type of the request", err)
+	}
+	// the link is up and the sidecar saw nothing
+	if _, _, err = i.OnReceivedContext(context.Background(), &base.PresenceWhoNowReq{Channel: "ch"}); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := s.requests(); len(reqs) != 1 || reqs[0].Uri != UriPresenceWhoNow {
+		t.Fatalf("the sidecar got %d requests, want only the PresenceWhoNow one", len(reqs))
+	}
+}
+
+func TestErrorReplyKeepsItsBody(t *testing.T) {
+	const code = 3 // an rtm2 error code
+	body := []byte("details")
+	s := newFakeSidecar(t, func(h *Header) *Header {
+		return &Header{Uri: h.Uri, SeqId: h.SeqId, ErrCode: code, Message: body}
+	})
+	i := startInvoker(t, s.addr())
+
+	_, _, err := i.OnReceivedContext(context.Background(), &base.PresenceWhoNowReq{Channel: "ch"})
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || reqErr.Code != code {
+		t.Fatalf("got %v, want a RequestError of code %d", err, code)
+	}
+	if reqErr.Reply == nil || string(reqErr.Reply.Message) != string(body) || reqErr.Reply.Uri != UriPresenceWhoNow {
+		t.Fatalf("got reply %+v, want the body of the error reply", reqErr.Reply)
+	}
+
+	message, errCode, err := i.Invoke(context.Background(), 200, nil)
+	if err == nil || errCode != code || string(message) != string(body) {
+		t.Fatalf("Invoke got %q %d %v, want the body of the error reply", message, errCode, err)
+	}
+}
+
+func TestInvokeOnRawEventUri(t *testing.T) {
+	const uri = 201
+	s := newFakeSidecar(t, echo)
+	i := startInvoker(t, s.addr())
+	events := make(chan []byte, 1)
+	if err := i.SubscribeRaw(uri, func(uri int32, errCode int32, message []byte) { events <- message }); err != nil {
+		t.Fatal(err)
+	}
+	defer i.UnsubscribeRaw(uri)
+
+	if _, _, err := i.Invoke(context.Background(), uri, []byte("request")); err != nil {
+		t.Fatalf("the reply was taken for an event: %v", err)
+	}
+	select {
+	case message := <-events:
+		t.Fatalf("the reply %q reached the event handler", message)
+	default:
+	}
+
+	s.push(&Header{Uri: uri, Message: []byte("event")})
+	select {
+	case message := <-events:
+		if string(message) != "event" {
+			t.Fatalf("got event %q", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+}
+
+func TestSubscribeRecordsTheUsersTheSidecarTook(t *testing.T) {
+	s := newFakeSidecar(t, func(h *Header) *Header {
+		resp := echo(h)
+		if h.Uri == UriStreamSubTopic {
+			req := &base.StreamSubTopicReq{}
+			_ = req.Unmarshal(h.Message)
+			// the first user only, the others failed
+			resp.Message, _ = (&base.StreamSubTopicResp{Channel: req.Channel, Topic: req.Topic,
+				Succeed: req.UserIds[:1], Failed: req.UserIds[1:]}).Marshal()
+		}
+		return resp
+	})
+	i := startInvoker(t, s.addr())
+
+	if _, _, err := i.OnReceivedContext(context.Background(), &base.StreamSubTopicReq{Channel: "ch", Topic: "topic", UserIds: []string{"a", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if users := subscribedUsers(t, i); len(users) != 1 || users[0] != "a" {
+		t.Fatalf("got users %v, want [a]", users)
+	}
+	// no user listed leaves the whole topic
+	if _, _, err := i.OnReceivedContext(context.Background(), &base.StreamUnsubTopicReq{Channel: "ch", Topic: "topic"}); err != nil {
+		t.Fatal(err)
+	}
+	if users := subscribedUsers(t, i); len(users) != 0 {
+		t.Fatalf("got users %v after unsubscribing the topic", users)
+	}
+}
+
+func TestEndpointSessionRestoredAfterReconnect(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	client, errChan := loginClient(t, map[string]interface{}{kParamSidecarEndpoint: s.addr(), kParamReconnectBackoff: int32(10)})
+	defer client.Logout()
+	if _, _, err := client.invoker.OnReceivedContext(context.Background(), &base.MessageSubReq{Channel: "ch"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// as a sidecar restarted by whoever runs it
+	s.disconnect()
+	var uris []int32
+	waitFor(t, 5*time.Second, func() bool {
+		uris = uris[:0]
+		for _, h := range s.requests() {
+			uris = append(uris, h.Uri)
+		}
+		return len(uris) == 4
+	})
+	if want := []int32{UriLogin, UriMessageSubscribe, UriLogin, UriMessageSubscribe}; !reflect.DeepEqual(uris, want) {
+		t.Fatalf("the sidecar got uris %v, want %v", uris, want)
+	}
+	select {
+	case err := <-errChan:
+		t.Fatalf("reconnect reported as %v", err)
+	default:
+	}
+}
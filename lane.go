@@ -0,0 +1,109 @@
+package rtm2_sdk
+
+const (
+	defaultMetadataWeight = 4
+	defaultDataWeight     = 1
+)
+
+// lane is an outgoing queue of a connection. The writer always drains the control lane first,
+// then takes turns between metadata and data, up to their weight in requests per turn, so that a
+// token renewal or a lock never waits behind a backlog of publishes.
+type lane int
+
+const (
+	laneControl lane = iota
+	laneMetadata
+	laneData
+	laneCount
+)
+
+func (l lane) String() string {
+	switch l {
+	case laneControl:
+		return "control"
+	case laneMetadata:
+		return "metadata"
+	default:
+		return "data"
+	}
+}
+
+// laneOf classifies a request by uri: session control, publishes, and everything else as metadata.
+func laneOf(uri int32) lane {
+	switch uri {
+	case UriLogin, UriLogout, UriSetParam, UriRenewToken:
+		return laneControl
+	case UriMessagePublish, UriStreamPublish:
+		return laneData
+	default:
+		return laneMetadata
+	}
+}
+
+// lanes holds the queues of a connection and the weighted turn between metadata and data.
+// Only the writer pops, so the turn needs no lock.
+type lanes struct {
+	queues  [laneCount]chan *request
+	weights [laneCount]int
+	turn    lane
+	credit  int
+}
+
+func newLanes(size int, metadataWeight, dataWeight int) *lanes {
+	l := &lanes{turn: laneMetadata}
+	for idx := range l.queues {
+		l.queues[idx] = make(chan *request, size)
+	}
+	l.weights[laneMetadata] = metadataWeight
+	l.weights[laneData] = dataWeight
+	l.credit = metadataWeight
+	return l
+}
+
+func (l *lanes) of(r *request) chan *request {
+	return l.queues[laneOf(r.header.Uri)]
+}
+
+// next pops the request to write next, nil when every lane is empty.
+func (l *lanes) next() *request {
+	select {
+	case r := <-l.queues[laneControl]:
+		return r
+	default:
+	}
+	// the turn changes at most twice: out of credit, then the other lane being empty as well
+	for i := 0; i < 2; i++ {
+		if l.credit <= 0 {
+			if l.turn == laneMetadata {
+				l.turn = laneData
+			} else {
+				l.turn = laneMetadata
+			}
+			l.credit = l.weights[l.turn]
+		}
+		select {
+		case r := <-l.queues[l.turn]:
+			l.credit--
+			return r
+		default:
+			l.credit = 0
+		}
+	}
+	return nil
+}
+
+func (l *lanes) len() int {
+	n := 0
+	for _, q := range l.queues {
+		n += len(q)
+	}
+	return n
+}
+
+func (l *lanes) cap() int {
+	n := 0
+	for _, q := range l.queues {
+		n += cap(q)
+	}
+	return n
+}
@@ -0,0 +1,99 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLanesOrder(t *testing.T) {
+	l := newLanes(64, 2, 1)
+	push := func(uri int32, n int) {
+		for k := 0; k < n; k++ {
+			l.queues[laneOf(uri)] <- &request{header: &Header{Uri: uri}}
+		}
+	}
+	push(UriMessagePublish, 8)
+	push(UriPresenceWhoNow, 8)
+	push(UriRenewToken, 1)
+
+	want := []int32{UriRenewToken,
+		UriPresenceWhoNow, UriPresenceWhoNow, UriMessagePublish,
+		UriPresenceWhoNow, UriPresenceWhoNow, UriMessagePublish}
+	for k, uri := range want {
+		if r := l.next(); r == nil || r.header.Uri != uri {
+			t.Fatalf("request %d: got %v, want uri %d", k, r, uri)
+		}
+	}
+	// a control request queued behind a backlog is still next
+	push(UriRenewToken, 1)
+	if r := l.next(); r.header.Uri != UriRenewToken {
+		t.Fatalf("got uri %d, want the token renewal", r.header.Uri)
+	}
+	for l.next() != nil {
+	}
+	if l.len() != 0 {
+		t.Fatalf("%d requests left", l.len())
+	}
+}
+
+func TestRenewTokenUnderPublishSaturation(t *testing.T) {
+	const (
+		publishers = 256 // more than the data lane holds, so that it is never empty
+		renewals   = 20
+		bound      = 200 * time.Millisecond
+	)
+	s := newFakeSidecar(t, echo)
+	config := defaultConnectionConfig()
+	config.queueSize = 64
+	config.queuePolicy = QueueBlock
+	c := startConnection(t, s.addr(), config, nil)
+	if _, err := roundTrip(t, c, UriPresenceWhoNow, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for k := 0; k < publishers; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				rc := make(chan *Header, 1)
+				h := &Header{Uri: UriMessagePublish, Message: make([]byte, 1024)}
+				if err := c.SendRequest(ctx, h, rc); err != nil {
+					continue
+				}
+				select {
+				case <-rc:
+				case <-ctx.Done():
+					c.CancelRequest(h.SeqId)
+				}
+			}
+		}()
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	waitFor(t, time.Second, func() bool { return c.lanes.len() > 0 })
+
+	var worst time.Duration
+	queued := 0
+	for k := 0; k < renewals; k++ {
+		queued += c.lanes.len()
+		start := time.Now()
+		if _, err := roundTrip(t, c, UriRenewToken, time.Second); err != nil {
+			t.Fatalf("renewal %d: %v", k, err)
+		}
+		if d := time.Since(start); d > worst {
+			worst = d
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if worst > bound {
+		t.Fatalf("slowest renewal took %v, want under %v", worst, bound)
+	}
+	t.Logf("slowest renewal took %v with %d requests queued on average", worst, queued/renewals)
+}
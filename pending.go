@@ -0,0 +1,110 @@
+package rtm2_sdk
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultPendingTTL = time.Minute
+const defaultSweepInterval = time.Second
+
+// request is a queued header together with the channel waiting for its reply.
+// sent is set once the header has been written to a link.
+type request struct {
+	header   *Header
+	rc       chan<- *Header
+	deadline time.Time
+	sent     int32
+}
+
+func (r *request) isSent() bool {
+	return atomic.LoadInt32(&r.sent) != 0
+}
+
+// pendingTable tracks the requests waiting for a reply by seqId.
+// Every entry leaves the table exactly once: replied, canceled, expired or failed.
+type pendingTable struct {
+	mu      sync.Mutex
+	entries map[int64]*request
+}
+
+func newPendingTable() *pendingTable {
+	return &pendingTable{entries: make(map[int64]*request)}
+}
+
+func (p *pendingTable) add(r *request) {
+	p.mu.Lock()
+	p.entries[r.header.SeqId] = r
+	p.mu.Unlock()
+}
+
+func (p *pendingTable) contains(seqId int64) bool {
+	p.mu.Lock()
+	_, ok := p.entries[seqId]
+	p.mu.Unlock()
+	return ok
+}
+
+// take removes and returns the request, nil if it is no longer pending.
+func (p *pendingTable) take(seqId int64) *request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.entries[seqId]
+	if !ok {
+		return nil
+	}
+	delete(p.entries, seqId)
+	return r
+}
+
+// takeIf is take for a request matching filter, a request failing it stays pending.
+func (p *pendingTable) takeIf(seqId int64, filter func(r *request) bool) *request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.entries[seqId]
+	if !ok || !filter(r) {
+		return nil
+	}
+	delete(p.entries, seqId)
+	return r
+}
+
+// fail removes the requests matching filter and closes their reply channels.
+func (p *pendingTable) fail(filter func(r *request) bool) []int64 {
+	p.mu.Lock()
+	var failed []*request
+	for seqId, r := range p.entries {
+		if filter == nil || filter(r) {
+			failed = append(failed, r)
+			delete(p.entries, seqId)
+		}
+	}
+	p.mu.Unlock()
+	seqIds := make([]int64, 0, len(failed))
+	for _, r := range failed {
+		close(r.rc)
+		seqIds = append(seqIds, r.header.SeqId)
+	}
+	return seqIds
+}
+
+// sweep drops the requests whose deadline has passed without their waiter canceling them.
+func (p *pendingTable) sweep(now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := 0
+	for seqId, r := range p.entries {
+		if now.After(r.deadline) {
+			delete(p.entries, seqId)
+			count++
+		}
+	}
+	return count
+}
+
+func (p *pendingTable) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
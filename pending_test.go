@@ -0,0 +1,100 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPendingDrainsOnTimeout(t *testing.T) {
+	s := newFakeSidecar(t, nil) // never replies
+	c := startConnection(t, s.addr(), nil, nil)
+
+	if _, err := roundTrip(t, c, UriPresenceWhoNow, 50*time.Millisecond); !errors.Is(err, ERR_TIMEOUT) {
+		t.Fatalf("got %v, want ERR_TIMEOUT", err)
+	}
+	if n := c.requests.len(); n != 0 {
+		t.Fatalf("%d requests pending after timeout", n)
+	}
+}
+
+func TestPendingDrainsOnCancel(t *testing.T) {
+	s := newFakeSidecar(t, nil)
+	c := startConnection(t, s.addr(), nil, nil)
+
+	h := &Header{Uri: UriPresenceWhoNow}
+	if err := c.SendRequest(context.Background(), h, make(chan *Header, 1)); err != nil {
+		t.Fatal(err)
+	}
+	c.CancelRequest(h.SeqId)
+	if n := c.requests.len(); n != 0 {
+		t.Fatalf("%d requests pending after cancel", n)
+	}
+	if canceled := c.Stats().Canceled; canceled != 1 {
+		t.Fatalf("canceled %d, want 1", canceled)
+	}
+}
+
+func TestPendingDrainsOnSweep(t *testing.T) {
+	s := newFakeSidecar(t, nil)
+	config := defaultConnectionConfig()
+	config.pendingTTL = 20 * time.Millisecond
+	config.sweepInterval = 10 * time.Millisecond
+	c := startConnection(t, s.addr(), config, nil)
+
+	// a waiter that never cancels, without a deadline on its context
+	if err := c.SendRequest(context.Background(), &Header{Uri: UriPresenceWhoNow}, make(chan *Header, 1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, func() bool { return c.requests.len() == 0 })
+	if expired := c.Stats().Expired; expired != 1 {
+		t.Fatalf("expired %d, want 1", expired)
+	}
+}
+
+func TestPendingDrainsOnLateReply(t *testing.T) {
+	s := newFakeSidecar(t, func(h *Header) *Header {
+		time.Sleep(100 * time.Millisecond)
+		return echo(h)
+	})
+	c := startConnection(t, s.addr(), nil, nil)
+
+	if _, err := roundTrip(t, c, UriPresenceWhoNow, 20*time.Millisecond); !errors.Is(err, ERR_TIMEOUT) {
+		t.Fatalf("got %v, want ERR_TIMEOUT", err)
+	}
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&c.stats.lateReplies) == 1 })
+	if n := c.requests.len(); n != 0 {
+		t.Fatalf("%d requests pending after late reply", n)
+	}
+}
+
+func TestPendingDrainsOnReply(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	c := startConnection(t, s.addr(), nil, nil)
+
+	for i := 0; i < 100; i++ {
+		if _, err := roundTrip(t, c, UriPresenceWhoNow, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.requests.len(); n != 0 {
+		t.Fatalf("%d requests pending after replies", n)
+	}
+}
+
+func TestPendingTableFail(t *testing.T) {
+	p := newPendingTable()
+	sent := &request{header: &Header{SeqId: 1}, rc: make(chan *Header, 1), sent: 1}
+	queued := &request{header: &Header{SeqId: 2}, rc: make(chan *Header, 1)}
+	p.add(sent)
+	p.add(queued)
+
+	if failed := p.fail((*request).isSent); len(failed) != 1 || failed[0] != 1 {
+		t.Fatalf("failed %v, want only the sent request", failed)
+	}
+	if p.take(2) != queued || p.len() != 0 {
+		t.Fatalf("the queued request must stay pending until taken")
+	}
+}
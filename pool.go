@@ -0,0 +1,216 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// eventDedupWindow is how long an event is remembered to merge the copies the other links deliver.
+const eventDedupWindow = 10 * time.Second
+
+// channelRequest is implemented by the generated requests addressing a channel.
+type channelRequest interface {
+	GetChannel() string
+}
+
+// connectionPool spreads requests over several links to the sidecar. Requests of one channel always take
+// the same link, so they stay in order, while a busy channel does not hold back the others. Requests
+// without a channel, login and parameters for instance, take the first link.
+//
+// The sidecar may push an event of a client on any of its links, or on each of them. Every link hands events
+// over to one dispatcher, which keeps them in order, and the copies of an event arriving on several links
+// are merged by an eventDedup, so that an event is delivered once whichever links carry it.
+type connectionPool struct {
+	ctx     context.Context
+	conns   []*connection
+	errChan chan error
+}
+
+func connectionsFromParams(params map[string]interface{}) int {
+	return int(paramInt32(params, kParamConnections, 1))
+}
+
+func newConnectionPool(ctx context.Context, lg *zap.Logger, edp string, size int, config *connectionConfig, callback connectionCallback) *connectionPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &connectionPool{ctx: ctx, conns: make([]*connection, size), errChan: make(chan error, size)}
+	for idx := range p.conns {
+		connLg := lg
+		if size > 1 {
+			connLg = lg.With(zap.Int("link", idx))
+		}
+		p.conns[idx] = NewConnection(ctx, connLg, edp, config, callback)
+	}
+	if size > 1 {
+		dedup := newEventDedup(size, eventDedupWindow)
+		for idx, c := range p.conns {
+			c.link = idx
+			c.dedup = dedup
+			c.events = p.conns[0].events
+		}
+	}
+	return p
+}
+
+func (p *connectionPool) Start() {
+	for _, c := range p.conns {
+		c.Start()
+		go p.forward(c)
+	}
+}
+
+// forward hands the fatal error of a link to the pool, one broken link is enough to fail the client.
+func (p *connectionPool) forward(c *connection) {
+	select {
+	case <-p.ctx.Done():
+	case err := <-c.ErrorChan():
+		p.errChan <- err
+	}
+}
+
+func (p *connectionPool) ErrorChan() <-chan error {
+	return p.errChan
+}
+
+// pick returns the link carrying req.
+func (p *connectionPool) pick(req interface{}) *connection {
+	if len(p.conns) == 1 {
+		return p.conns[0]
+	}
+	r, ok := req.(channelRequest)
+	if !ok || r.GetChannel() == "" {
+		return p.conns[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(r.GetChannel()))
+	return p.conns[h.Sum32()%uint32(len(p.conns))]
+}
+
+func (p *connectionPool) SetEndpoint(edp string) {
+	for _, c := range p.conns {
+		c.SetEndpoint(edp)
+	}
+}
+
+// Reconnected is signaled when the first link, the one carrying login, is established again.
+func (p *connectionPool) Reconnected() <-chan struct{} {
+	return p.conns[0].Reconnected()
+}
+
+func (p *connectionPool) Redial() {
+	for _, c := range p.conns {
+		c.Redial()
+	}
+}
+
+func (p *connectionPool) Route(index uint64, callback connectionCallback) {
+	for _, c := range p.conns {
+		c.Route(index, callback)
+	}
+}
+
+// Stats sums the counters of every link.
+func (p *connectionPool) Stats() ConnectionStats {
+	var stats ConnectionStats
+	for _, c := range p.conns {
+		s := c.Stats()
+		stats.Pending += s.Pending
+		stats.Canceled += s.Canceled
+		stats.Expired += s.Expired
+		stats.LateReplies += s.LateReplies
+		stats.Duplicates += s.Duplicates
+		stats.QueueDepth += s.QueueDepth
+		stats.QueueCapacity += s.QueueCapacity
+		stats.QueueRejected += s.QueueRejected
+		stats.QueueDropped += s.QueueDropped
+	}
+	// the links share one dispatcher
+	stats.Events = p.conns[0].events.Stats()
+	stats.Links = len(p.conns)
+	return stats
+}
+
+// eventKey identifies an event by its content, the sidecar gives events no id of their own.
+// The message is hashed to keep the window small under a flood of large events.
+type eventKey struct {
+	uri       int32
+	connIndex uint64
+	seqId     int64
+	size      int
+	sum       uint64
+}
+
+func eventKeyOf(h *Header) eventKey {
+	sum := fnv.New64a()
+	_, _ = sum.Write(h.Message)
+	return eventKey{uri: h.Uri, connIndex: h.ConnIndex, seqId: h.SeqId, size: len(h.Message), sum: sum.Sum64()}
+}
+
+// eventCopies counts the copies of an event: delivered is the number of such events handed over so far,
+// seen the number each link has carried. A link carrying more copies than were delivered carries a new one.
+type eventCopies struct {
+	delivered int
+	seen      []int
+	at        time.Time
+}
+
+// eventDedup merges the copies of an event arriving on several links of a pool. An event is delivered by the
+// first link carrying it, whichever it is, and the same event sent twice by the sidecar is still delivered twice.
+type eventDedup struct {
+	links  int
+	window time.Duration
+
+	mu     sync.Mutex
+	events map[eventKey]*eventCopies
+	order  []eventKey
+}
+
+func newEventDedup(links int, window time.Duration) *eventDedup {
+	return &eventDedup{links: links, window: window, events: make(map[eventKey]*eventCopies)}
+}
+
+// first reports whether h, arriving on link, is an event not delivered yet.
+func (d *eventDedup) first(link int, h *Header) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.expire(now)
+	key := eventKeyOf(h)
+	e, ok := d.events[key]
+	if !ok {
+		e = &eventCopies{seen: make([]int, d.links), at: now}
+		d.events[key] = e
+		d.order = append(d.order, key)
+	}
+	e.seen[link]++
+	if e.seen[link] <= e.delivered {
+		return false
+	}
+	e.delivered = e.seen[link]
+	return true
+}
+
+// rejoin counts every remembered event as seen by link, which was down and missed them,
+// so that its next copy of one of them is taken for a new event.
+func (d *eventDedup) rejoin(link int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.events {
+		e.seen[link] = e.delivered
+	}
+}
+
+func (d *eventDedup) expire(now time.Time) {
+	for len(d.order) != 0 {
+		key := d.order[0]
+		if now.Sub(d.events[key].at) < d.window {
+			return
+		}
+		delete(d.events, key)
+		d.order = d.order[1:]
+	}
+}
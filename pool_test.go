@@ -0,0 +1,133 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func startPool(t *testing.T, s *fakeSidecar, links int, callback connectionCallback) *connectionPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	p := newConnectionPool(ctx, zap.NewNop(), s.addr(), links, nil, callback)
+	p.Start()
+	for _, c := range p.conns {
+		if _, err := roundTrip(t, c, UriPresenceWhoNow, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// expectEvents checks that the events numbered 0 to count-1 are delivered once, in order.
+func expectEvents(t *testing.T, callback *events, count int) {
+	for k := 0; k < count; k++ {
+		select {
+		case h := <-callback.ch:
+			if h.Message[0] != byte(k) {
+				t.Fatalf("event %d delivered as %d", k, h.Message[0])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d events out of %d", k, count)
+		}
+	}
+	select {
+	case h := <-callback.ch:
+		t.Fatalf("event %d delivered twice", h.Message[0])
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPoolDeliversEachEventOnce(t *testing.T) {
+	const links = 3
+	s := newFakeSidecar(t, echo)
+	callback := newEvents()
+	p := startPool(t, s, links, callback)
+
+	// every event is pushed on each link
+	const events = 5
+	for k := 0; k < events; k++ {
+		s.push(&Header{Uri: UriMessageEvent, Message: []byte{byte(k)}})
+	}
+	expectEvents(t, callback, events)
+	waitFor(t, time.Second, func() bool { return p.Stats().Duplicates == (links-1)*events })
+	if dispatched := p.Stats().Events.Dispatched; dispatched != events {
+		t.Fatalf("%d events dispatched, want %d", dispatched, events)
+	}
+}
+
+func TestPoolDeliversEventsOfASingleLink(t *testing.T) {
+	const links = 3
+	s := newFakeSidecar(t, echo)
+	callback := newEvents()
+	p := startPool(t, s, links, callback)
+
+	// the events are pushed on the last link only
+	const events = 5
+	for k := 0; k < events; k++ {
+		s.pushTo(p.conns[links-1], &Header{Uri: UriMessageEvent, Message: []byte{byte(k)}})
+	}
+	expectEvents(t, callback, events)
+	if duplicates := p.Stats().Duplicates; duplicates != 0 {
+		t.Fatalf("%d events taken for duplicates", duplicates)
+	}
+}
+
+func TestEventDedup(t *testing.T) {
+	event := &Header{Uri: UriMessageEvent, Message: []byte("hello")}
+	other := &Header{Uri: UriMessageEvent, Message: []byte("world")}
+	cases := []struct {
+		name  string
+		links []int // link carrying each copy of event
+		want  []bool
+	}{
+		{"one link", []int{0}, []bool{true}},
+		{"copies on each link", []int{0, 1, 2}, []bool{true, false, false}},
+		{"copy on a later link first", []int{2, 0, 1}, []bool{true, false, false}},
+		{"sent twice on one link", []int{1, 1}, []bool{true, true}},
+		{"sent twice on two links", []int{0, 1, 0, 1}, []bool{true, false, true, false}},
+		{"second one overtaking", []int{0, 0, 1, 1}, []bool{true, true, false, false}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newEventDedup(3, time.Minute)
+			if !d.first(0, other) {
+				t.Fatal("another event taken for a duplicate")
+			}
+			for k, link := range tc.links {
+				if got := d.first(link, event); got != tc.want[k] {
+					t.Fatalf("copy %d on link %d: got %v, want %v", k, link, got, tc.want[k])
+				}
+			}
+		})
+	}
+}
+
+func TestEventDedupAfterRejoin(t *testing.T) {
+	event := &Header{Uri: UriLockEvent, Message: []byte("lock")}
+	d := newEventDedup(2, time.Minute)
+	// link 1 is down while link 0 delivers the event, then the sidecar sends it again
+	if !d.first(0, event) {
+		t.Fatal("event taken for a duplicate")
+	}
+	d.rejoin(1)
+	if !d.first(1, event) {
+		t.Fatal("event sent again after the link came back taken for a duplicate")
+	}
+	if d.first(0, event) {
+		t.Fatal("copy delivered twice")
+	}
+}
+
+func TestEventDedupForgets(t *testing.T) {
+	event := &Header{Uri: UriMessageEvent, Message: []byte("hello")}
+	d := newEventDedup(2, time.Millisecond)
+	d.first(0, event)
+	time.Sleep(5 * time.Millisecond)
+	d.first(0, &Header{Uri: UriMessageEvent})
+	if len(d.events) != 1 {
+		t.Fatalf("%d events remembered past the window", len(d.events))
+	}
+}
@@ -2,87 +2,521 @@ package rtm2_sdk
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/tevino/abool/v2"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
+const (
+	defaultSidecarBinary     = "rtm2-wrapper.exe"
+	defaultReadyTimeout      = time.Second * 10
+	defaultProbeInterval     = time.Millisecond * 100
+	defaultRestartBackoff    = time.Second
+	defaultRestartMaxBackoff = time.Second * 30
+	defaultStopGrace         = time.Second * 3
+	// a sidecar running longer than this is considered healthy, its next crash starts a fresh restart budget
+	sidecarStableAfter = time.Minute
+	maxPortAttempts    = 16
+)
+
+var (
+	errSidecarExited = errors.New("sidecar exited")
+	errNoFreePort    = errors.New("no free port for sidecar")
+
+	// ErrSocketUnsupported is reported when a sidecar spawned with golang_sidecar_transport unix exits
+	// before ever listening on its socket, as a wrapper not knowing --socket does.
+	ErrSocketUnsupported = errors.New("sidecar never listened on its socket, --socket may not be supported")
+)
+
+// SidecarStats is a snapshot of the sidecar supervisor.
+type SidecarStats struct {
+	Running    bool
+	Pid        int
+	Restarts   int64     // times the sidecar was started again after exiting
+	LastExit   string    // error the last run ended with, empty if it never exited
+	LastCode   int       // exit code of the last run, -1 when killed by a signal
+	LastExitAt time.Time // zero if it never exited
+}
+
+// sidecarConfig holds how the sidecar is spawned and supervised, see sidecarConfigFromParams.
+type sidecarConfig struct {
+	path         string
+	binary       string
+	port         int32
+	unix         bool
+	args         []string
+	dir          string
+	libPath      string
+	env          map[string]string
+	rlimits      map[string]uint64
+	restart      backoff
+	readyTimeout time.Duration
+	stopGrace    time.Duration
+	logRate      int
+	logTail      int
+}
+
+func sidecarConfigFromParams(params map[string]interface{}) *sidecarConfig {
+	config := &sidecarConfig{path: ".", binary: defaultSidecarBinary, restart: defaultBackoff()}
+	if value, ok := params[kParamSidecarPort]; ok {
+		if port, ok := value.(int32); ok {
+			config.port = port
+		}
+	}
+	if value, ok := params[kParamSidecarPath]; ok {
+		config.path = value.(string)
+	}
+	if value, ok := params[kParamSidecarTransport].(string); ok && value == "unix" {
+		config.unix = true
+	}
+	if value, ok := params[kParamSidecarBinary].(string); ok && value != "" {
+		config.binary = value
+	}
+	config.args, _ = params[kParamSidecarArgs].([]string)
+	config.dir, _ = params[kParamSidecarDir].(string)
+	config.libPath, _ = params[kParamSidecarLibPath].(string)
+	config.env, _ = params[kParamSidecarEnv].(map[string]string)
+	config.rlimits, _ = params[kParamSidecarRlimits].(map[string]uint64)
+	config.restart.retries = int(paramInt32(params, kParamSidecarRestartRetries, int32(config.restart.retries)))
+	config.restart.initial = paramMillis(params, kParamSidecarRestartBackoff, defaultRestartBackoff)
+	config.restart.max = paramMillis(params, kParamSidecarRestartMaxBackoff, defaultRestartMaxBackoff)
+	config.readyTimeout = paramMillis(params, kParamSidecarReadyTimeout, defaultReadyTimeout)
+	config.stopGrace = paramMillis(params, kParamSidecarStopGrace, defaultStopGrace)
+	config.logRate = int(paramInt32(params, kParamSidecarLogRate, defaultSidecarLogRate))
+	config.logTail = int(paramInt32(params, kParamSidecarLogTail, 0))
+	return config
+}
+
 type rtmSidecar struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	cmd  string
-	args []string
+	cmd    string
+	config *sidecarConfig
 
-	process *exec.Cmd
-	errChan chan error
+	started abool.AtomicBool
+	done    chan struct{}
+	sockDir string
+
+	mu         sync.Mutex
+	edp        string
+	port       int32
+	listening  bool
+	listened   bool // some generation listened
+	process    *exec.Cmd
+	stats      SidecarStats
+	generation int
+	limiter    *logLimiter
+
+	errChan   chan error
+	readyChan chan int
 
 	lg *zap.Logger
 }
 
+// Start supervises the sidecar, restarting it with backoff whenever it exits.
+// The returned channel only reports an error once the restart budget is exhausted.
 func (s *rtmSidecar) Start() <-chan error {
-	p := exec.Command(s.cmd, s.args...)
-	s.process = p
-	// capture sub process std err and std out
-	p.Stderr = os.Stderr
-	p.Stdout = os.Stdout
-	go s.loop()
+	if s.started.SetToIf(false, true) {
+		go s.supervise()
+	}
 	return s.errChan
 }
 
-func (s *rtmSidecar) StartV1() <-chan error {
-	p := exec.CommandContext(s.ctx, s.cmd, s.args...)
-	//p.Cancel = func() error {
-	//	if err := p.Process.Signal(syscall.SIGTERM); err != nil {
-	//		s.lg.Error("fail to sigterm sidecar, we should kill it", zap.Error(err))
-	//	}
-	//	return p.Process.Kill()
-	//}
-	err := p.Start()
+// Ready delivers the generation of the sidecar each time it accepts connections, starting from 1.
+func (s *rtmSidecar) Ready() <-chan int {
+	return s.readyChan
+}
+
+// WaitReady waits for the first generation of the sidecar to accept connections.
+func (s *rtmSidecar) WaitReady(ctx context.Context) (int, error) {
+	timer := time.NewTimer(s.config.readyTimeout)
+	defer timer.Stop()
+	select {
+	case gen := <-s.readyChan:
+		return gen, nil
+	case <-timer.C:
+		return 0, ERR_TIMEOUT
+	case <-s.done:
+		return 0, errSidecarExited
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (s *rtmSidecar) Stats() SidecarStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Stop terminates the sidecar and waits for it to be reaped: SIGTERM first, SIGKILL once stopGrace elapses
+// or ctx is done. It is safe to call several times, on a nil sidecar or on one never started.
+func (s *rtmSidecar) Stop(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.cancel()
+	if !s.started.IsSet() {
+		s.cleanup()
+		return nil
+	}
+	defer s.cleanup()
+	// run never starts a process once canceled, so this is the last one
+	s.mu.Lock()
+	p := s.process
+	s.mu.Unlock()
+	if p != nil {
+		if err := p.Process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			s.lg.Error("fail to sigterm sidecar, we should kill it", zap.Error(err))
+		}
+	}
+	grace := time.NewTimer(s.config.stopGrace)
+	defer grace.Stop()
+	select {
+	case <-s.done:
+		return nil
+	case <-grace.C:
+		s.lg.Warn("sidecar still running after grace period, kill it", zap.Duration("grace", s.config.stopGrace))
+	case <-ctx.Done():
+		s.lg.Warn("stop canceled, kill sidecar", zap.Error(ctx.Err()))
+	}
+	if p != nil {
+		if err := p.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			s.lg.Error("fail to kill process", zap.Error(err))
+		}
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Endpoint returns where the sidecar listens, unix://<path> when it is spawned on a socket file.
+// An automatically allocated port is only known once the first generation is launched.
+func (s *rtmSidecar) Endpoint() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.edp
+}
+
+// cleanup releases the allocated port and removes the private socket directory once the sidecar is gone.
+func (s *rtmSidecar) cleanup() {
+	select {
+	case <-s.done:
+	default:
+		if s.started.IsSet() {
+			// still running, cleaned up by the next Stop
+			return
+		}
+	}
+	s.mu.Lock()
+	if s.config.port == 0 && s.port != 0 {
+		releasePort(s.port)
+		s.port = 0
+	}
+	s.mu.Unlock()
+	if s.sockDir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.sockDir); err != nil {
+		s.lg.Warn("failed to remove socket directory", zap.String("dir", s.sockDir), zap.Error(err))
+	}
+}
+
+func (s *rtmSidecar) supervise() {
+	defer close(s.done)
+	attempt := 0
+	for {
+		started := time.Now()
+		err := s.run()
+		if s.ctx.Err() != nil {
+			if !errors.Is(err, context.Canceled) {
+				s.onExit(err)
+			}
+			s.lg.Info("sidecar stopped", zap.Error(err))
+			return
+		}
+		s.onExit(err)
+		if s.sockDir != "" && !s.hasListened() {
+			// restarting a wrapper that rejects --socket would never help
+			err = socketUnsupported(err)
+			s.lg.Error("sidecar exited before listening on its socket, give up", zap.Error(err))
+			s.cancel()
+			s.errChan <- err
+			return
+		}
+		if time.Since(started) > sidecarStableAfter {
+			attempt = 0
+		}
+		attempt++
+		if s.config.restart.exhausted(attempt) {
+			s.lg.Error("process stopped too many times, it should be a fatal error", zap.Int("attempts", attempt), zap.Error(err))
+			s.cancel()
+			s.errChan <- err
+			return
+		}
+		delay := s.config.restart.delay(attempt)
+		s.lg.Warn("process stopped, restart later", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		s.mu.Lock()
+		s.stats.Restarts++
+		s.mu.Unlock()
+	}
+}
+
+// run starts one generation of the sidecar and waits for it to exit.
+func (s *rtmSidecar) run() error {
+	edp, args, err := s.prepare()
 	if err != nil {
-		close(s.errChan)
-	} else {
+		return err
+	}
+	p := exec.Command(s.cmd, args...)
+	p.Dir = s.config.dir
+	p.Env = s.config.environ(os.Environ())
+	// capture sub process std err and std out, exec copies them until the process exits
+	tail := newLogTail(s.config.logTail)
+	stdout := newSidecarLogWriter(s.lg, "stdout", zapcore.InfoLevel, s.limiter, tail)
+	stderr := newSidecarLogWriter(s.lg, "stderr", zapcore.WarnLevel, s.limiter, tail)
+	p.Stdout = stdout
+	p.Stderr = stderr
+	s.mu.Lock()
+	if err := s.ctx.Err(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if err := p.Start(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if err := setRlimits(p.Process.Pid, s.config.rlimits); err != nil {
+		s.mu.Unlock()
+		s.lg.Error("failed to set resource limits, kill sidecar", zap.Error(err))
+		_ = p.Process.Kill()
+		_ = p.Wait()
+		return err
 	}
 	s.process = p
-	go s.loop()
-	return s.errChan
+	s.generation++
+	gen := s.generation
+	s.stats.Running = true
+	s.stats.Pid = p.Process.Pid
+	s.mu.Unlock()
+
+	exited := make(chan struct{})
+	go s.probe(p, gen, edp, exited)
+	err = p.Wait()
+	close(exited)
+	stdout.flush()
+	stderr.flush()
+	if err == nil {
+		err = errSidecarExited
+	}
+	if lines := tail.snapshot(); len(lines) != 0 {
+		err = &SidecarExitError{Err: err, Tail: lines}
+	}
+	return err
 }
 
-func (s *rtmSidecar) Stop() {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Recovered:", r)
+// prepare returns the endpoint and the arguments of the next generation. An allocated port is kept across
+// restarts, unless the previous generation exited before listening on it, which is what a failed bind looks like.
+func (s *rtmSidecar) prepare() (string, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sockDir != "" {
+		sock := strings.TrimPrefix(s.edp, unixScheme)
+		// a socket file left by a crashed generation would make the next bind fail
+		_ = os.Remove(sock)
+		return s.edp, append([]string{fmt.Sprintf("--socket=%s", sock), "--mode=1"}, s.config.args...), nil
+	}
+	if s.config.port == 0 && (s.port == 0 || !s.listening) {
+		port, err := allocatePort()
+		if err != nil {
+			return "", nil, err
 		}
-	}()
-	if s.process.Process != nil {
-		if err := s.process.Process.Signal(syscall.SIGTERM); err != nil {
-			s.lg.Error("fail to sigterm sidecar, we should kill it", zap.Error(err))
-			if err = s.process.Process.Kill(); err != nil {
-				s.lg.Error("fail to kill process", zap.Error(err))
-				time.Sleep(5 * time.Second)
+		if s.port != 0 {
+			s.lg.Warn("sidecar never listened, switch port", zap.Int32("from", s.port), zap.Int32("to", port))
+			releasePort(s.port)
+		}
+		s.port = port
+		s.edp = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	s.listening = false
+	return s.edp, append([]string{fmt.Sprintf("--port=%d", s.port), "--mode=1"}, s.config.args...), nil
+}
+
+// probe polls the sidecar endpoint until it accepts connections, killing the process if it never does.
+func (s *rtmSidecar) probe(p *exec.Cmd, gen int, edp string, exited <-chan struct{}) {
+	deadline := time.Now().Add(s.config.readyTimeout)
+	network, address := splitEndpoint(edp)
+	for {
+		if conn, err := net.DialTimeout(network, address, defaultProbeInterval); err == nil {
+			_ = conn.Close()
+			s.mu.Lock()
+			s.listening = true
+			s.listened = true
+			s.mu.Unlock()
+			s.lg.Info("sidecar ready", zap.Int("generation", gen), zap.String("endpoint", edp))
+			select {
+			case s.readyChan <- gen:
+			default:
+				// nobody consumed the previous generation, replace it
+				select {
+				case <-s.readyChan:
+				default:
+				}
+				s.readyChan <- gen
 			}
-		} else {
-			time.Sleep(time.Second)
+			return
+		}
+		if time.Now().After(deadline) {
+			s.lg.Error("sidecar not ready in time, kill it", zap.Duration("timeout", s.config.readyTimeout))
+			_ = p.Process.Kill()
+			return
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-exited:
+			return
+		case <-time.After(defaultProbeInterval):
 		}
 	}
 }
 
-func (s *rtmSidecar) loop() {
-	err := s.process.Run()
-	if err != nil {
-		s.lg.Error("process stopped, it should be a fatal error", zap.Error(err))
-		s.cancel()
-		s.errChan <- err
-	} else {
-		close(s.errChan)
+func (s *rtmSidecar) hasListened() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listened
+}
+
+// socketUnsupported wraps the exit error of a sidecar that never listened on its socket, keeping its output.
+func socketUnsupported(err error) error {
+	var exitErr *SidecarExitError
+	if errors.As(err, &exitErr) {
+		return &SidecarExitError{Err: fmt.Errorf("%w: %v", ErrSocketUnsupported, exitErr.Err), Tail: exitErr.Tail}
 	}
+	return fmt.Errorf("%w: %v", ErrSocketUnsupported, err)
 }
 
-func createSidecar(ctx context.Context, lg *zap.Logger, execPath string, port int32) *rtmSidecar {
+func (s *rtmSidecar) onExit(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Running = false
+	s.stats.Pid = 0
+	s.stats.LastExit = err.Error()
+	s.stats.LastExitAt = time.Now()
+	s.stats.LastCode = 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		s.stats.LastCode = exitErr.ExitCode()
+	}
+}
+
+// environ returns the environment of the sidecar: the parent one with the configured overrides,
+// and libPath prepended to LD_LIBRARY_PATH.
+func (c *sidecarConfig) environ(parent []string) []string {
+	env := make([]string, 0, len(parent)+len(c.env)+1)
+	for _, kv := range parent {
+		key := kv
+		if idx := strings.IndexByte(kv, '='); idx >= 0 {
+			key = kv[:idx]
+		}
+		if _, ok := c.env[key]; ok {
+			continue
+		}
+		if key == "LD_LIBRARY_PATH" && c.libPath != "" {
+			continue
+		}
+		env = append(env, kv)
+	}
+	for key, value := range c.env {
+		if key == "LD_LIBRARY_PATH" && c.libPath != "" {
+			continue
+		}
+		env = append(env, key+"="+value)
+	}
+	if c.libPath != "" {
+		libPath := c.libPath
+		if value, ok := c.env["LD_LIBRARY_PATH"]; ok {
+			libPath += ":" + value
+		} else if value, ok := os.LookupEnv("LD_LIBRARY_PATH"); ok && value != "" {
+			libPath += ":" + value
+		}
+		env = append(env, "LD_LIBRARY_PATH="+libPath)
+	}
+	return env
+}
+
+func createSidecar(ctx context.Context, lg *zap.Logger, config *sidecarConfig) (*rtmSidecar, error) {
 	c, cancel := context.WithCancel(ctx)
-	return &rtmSidecar{ctx: c, cancel: cancel, cmd: fmt.Sprintf("%s/rtm2-wrapper.exe", execPath),
-		args: []string{fmt.Sprintf("--port=%d", port), "--mode=1"}, errChan: make(chan error, 1), lg: lg}
+	cmd := config.binary
+	if !filepath.IsAbs(cmd) {
+		cmd = fmt.Sprintf("%s/%s", config.path, config.binary)
+	}
+	s := &rtmSidecar{ctx: c, cancel: cancel, cmd: cmd, config: config, limiter: &logLimiter{rate: config.logRate},
+		done: make(chan struct{}), errChan: make(chan error, 1), readyChan: make(chan int, 1), lg: lg.With(zap.String("component", "sidecar"))}
+	if config.unix {
+		// a private directory keeps other local users away from the socket
+		dir, err := os.MkdirTemp("", "rtm2-sidecar-")
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		s.sockDir = dir
+		s.edp = unixScheme + filepath.Join(dir, "rtm2.sock")
+	} else if config.port != 0 {
+		s.port = config.port
+		s.edp = fmt.Sprintf("127.0.0.1:%d", config.port)
+	}
+	return s, nil
+}
+
+// reservedPorts holds the ports allocated to the sidecars of this process, so that clients created
+// concurrently never pick the same one between probing a port and the sidecar binding it.
+var reservedPorts = struct {
+	sync.Mutex
+	ports map[int32]struct{}
+}{ports: make(map[int32]struct{})}
+
+// allocatePort asks the kernel for a free local port and reserves it until releasePort.
+func allocatePort() (int32, error) {
+	for i := 0; i < maxPortAttempts; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, err
+		}
+		port := int32(l.Addr().(*net.TCPAddr).Port)
+		_ = l.Close()
+		reservedPorts.Lock()
+		if _, ok := reservedPorts.ports[port]; !ok {
+			reservedPorts.ports[port] = struct{}{}
+			reservedPorts.Unlock()
+			return port, nil
+		}
+		reservedPorts.Unlock()
+	}
+	return 0, errNoFreePort
+}
+
+func releasePort(port int32) {
+	reservedPorts.Lock()
+	defer reservedPorts.Unlock()
+	delete(reservedPorts.ports, port)
 }
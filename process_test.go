@@ -0,0 +1,203 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	base "github.com/tomasliu-agora/rtm2-base"
+)
+
+func TestAllocatePortInParallel(t *testing.T) {
+	const n = 64
+	ports := make([]int32, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for k := 0; k < n; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			ports[k], errs[k] = allocatePort()
+		}(k)
+	}
+	wg.Wait()
+
+	seen := make(map[int32]bool, n)
+	for k, port := range ports {
+		if errs[k] != nil {
+			t.Fatalf("allocatePort: %v", errs[k])
+		}
+		if seen[port] {
+			t.Fatalf("port %d allocated twice", port)
+		}
+		seen[port] = true
+	}
+
+	for _, port := range ports {
+		wg.Add(1)
+		go func(port int32) {
+			defer wg.Done()
+			releasePort(port)
+		}(port)
+	}
+	wg.Wait()
+	reservedPorts.Lock()
+	defer reservedPorts.Unlock()
+	for _, port := range ports {
+		if _, ok := reservedPorts.ports[port]; ok {
+			t.Fatalf("port %d still reserved after releasePort", port)
+		}
+	}
+}
+
+func TestSupervisorRestartsAndRestores(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "requests")
+	client, errChan := loginClient(t, helperParams(t, map[string]string{helperLogEnv: log}))
+	defer client.Logout()
+	i := client.invoker
+	if _, _, err := i.OnReceivedContext(context.Background(), &base.MessageSubReq{Channel: "ch"}); err != nil {
+		t.Fatal(err)
+	}
+	first := client.Stats().Sidecar
+	if !first.Running || first.Pid == 0 {
+		t.Fatalf("sidecar not running: %+v", first)
+	}
+
+	if err := syscall.Kill(first.Pid, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		stats := client.Stats().Sidecar
+		return stats.Running && stats.Pid != first.Pid && stats.Restarts == 1
+	})
+	second := client.Stats().Sidecar
+	if second.LastCode != -1 || second.LastExitAt.IsZero() {
+		t.Fatalf("the kill is not recorded: %+v", second)
+	}
+	// the session is restored on the new sidecar, login first
+	waitFor(t, 5*time.Second, func() bool { return len(helperRequests(t, log)[second.Pid]) >= 2 })
+	if reqs := helperRequests(t, log)[second.Pid]; reqs[0] != UriLogin || reqs[1] != UriMessageSubscribe {
+		t.Fatalf("the new sidecar got uris %v, want the login then the subscription", reqs)
+	}
+	if _, _, err := i.OnReceivedContext(context.Background(), &base.PresenceWhoNowReq{Channel: "ch"}); err != nil {
+		t.Fatalf("request after the restart: %v", err)
+	}
+	select {
+	case err := <-errChan:
+		t.Fatalf("restart reported as %v", err)
+	default:
+	}
+}
+
+func TestSpawnClientsInParallel(t *testing.T) {
+	const n = 8
+	dir := t.TempDir()
+	clients := make([]*rtm2Client, n)
+	markers := make([]string, n)
+	for k := range clients {
+		// the first generation of every sidecar fails to bind
+		markers[k] = filepath.Join(dir, strconv.Itoa(k))
+		clients[k], _ = newClient(helperParams(t, map[string]string{helperFailFirstEnv: markers[k]}))
+	}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for k, client := range clients {
+		wg.Add(1)
+		go func(k int, client *rtm2Client) {
+			defer wg.Done()
+			_, _, errs[k] = client.Login("token")
+		}(k, client)
+	}
+	wg.Wait()
+
+	var ports []int32
+	endpoints := make(map[string]bool, n)
+	for k, client := range clients {
+		if errs[k] != nil {
+			t.Fatalf("client %d: login: %v", k, errs[k])
+		}
+		edp := client.invoker.sidecar.Endpoint()
+		if endpoints[edp] {
+			t.Fatalf("endpoint %s given to two sidecars", edp)
+		}
+		endpoints[edp] = true
+		failed, err := os.ReadFile(markers[k])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edp == "127.0.0.1:"+string(failed) {
+			t.Fatalf("client %d: sidecar restarted on port %s it failed to bind", k, failed)
+		}
+		if restarts := client.Stats().Sidecar.Restarts; restarts != 1 {
+			t.Fatalf("client %d: %d restarts, want 1", k, restarts)
+		}
+		for _, port := range []string{string(failed), strings.TrimPrefix(edp, "127.0.0.1:")} {
+			value, _ := strconv.Atoi(port)
+			ports = append(ports, int32(value))
+		}
+	}
+
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *rtm2Client) {
+			defer wg.Done()
+			_ = client.Logout()
+		}(client)
+	}
+	wg.Wait()
+	for _, client := range clients {
+		waitFor(t, 5*time.Second, func() bool { return !client.Stats().Sidecar.Running })
+	}
+	reservedPorts.Lock()
+	defer reservedPorts.Unlock()
+	for _, port := range ports {
+		if _, ok := reservedPorts.ports[port]; ok {
+			t.Fatalf("port %d still reserved after logout", port)
+		}
+	}
+}
+
+func TestUnixSocketTransport(t *testing.T) {
+	params := helperParams(t, nil)
+	params[kParamSidecarTransport] = "unix"
+	client, _ := loginClient(t, params)
+	defer client.Logout()
+	if edp := client.invoker.sidecar.Endpoint(); !strings.HasPrefix(edp, unixScheme) {
+		t.Fatalf("sidecar listens on %s, want a socket", edp)
+	}
+	if _, _, err := client.invoker.OnReceivedContext(context.Background(), &base.PresenceWhoNowReq{Channel: "ch"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnixSocketUnsupportedFailsFast(t *testing.T) {
+	params := helperParams(t, map[string]string{helperNoSocketEnv: "1"})
+	params[kParamSidecarTransport] = "unix"
+	params[kParamSidecarLogTail] = int32(5)
+	client, errChan := newClient(params)
+	start := time.Now()
+	if _, _, err := client.Login("token"); err == nil {
+		t.Fatal("logged in without a sidecar")
+	}
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, ErrSocketUnsupported) || !strings.Contains(err.Error(), "unknown option --socket") {
+			t.Fatalf("got %v, want ErrSocketUnsupported with the output of the sidecar", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+	if restarts := client.Stats().Sidecar.Restarts; restarts != 0 {
+		t.Fatalf("sidecar restarted %d times", restarts)
+	}
+}
@@ -0,0 +1,69 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+)
+
+// RawEventHandler receives the events of a uri subscribed with SubscribeRaw, undecoded.
+type RawEventHandler func(uri int32, errCode int32, message []byte)
+
+// rawMessage is a payload sent as is, for the uris the SDK has no request type for.
+type rawMessage []byte
+
+func (m rawMessage) Marshal() ([]byte, error) {
+	return m, nil
+}
+
+func (m rawMessage) MarshalTo(data []byte) (int, error) {
+	return copy(data, m), nil
+}
+
+func (m rawMessage) Size() int {
+	return len(m)
+}
+
+// Invoke sends payload to uri as is and returns the body of the reply with its error code, so that an operation
+// of the sidecar can be used before the SDK has a request type for it. Timeouts and retries apply as to any
+// request of uri, but the session does not record it and cannot restore it after a reconnection.
+// The body of an error reply is returned along with the error.
+func (i *rtmInvoker) Invoke(ctx context.Context, uri int32, payload []byte) ([]byte, int32, error) {
+	resp, err := i.send(ctx, uri, rawMessage(payload))
+	if err != nil {
+		var reqErr *RequestError
+		if errors.As(err, &reqErr) && reqErr.Reply != nil {
+			return reqErr.Reply.Message, reqErr.Code, err
+		}
+		return nil, ErrCode(err), err
+	}
+	return resp.Message, resp.ErrCode, nil
+}
+
+// SubscribeRaw hands the events the sidecar pushes on uri to handler, undecoded. The uris registered already,
+// as a request or an event, are refused; subscribing uri again replaces its handler.
+func (i *rtmInvoker) SubscribeRaw(uri int32, handler RawEventHandler) error {
+	if handler == nil {
+		return fmt.Errorf("nil handler for uri %d", uri)
+	}
+	if err := registry.addRaw(uri); err != nil {
+		return err
+	}
+	i.raw.Store(uri, handler)
+	return nil
+}
+
+func (i *rtmInvoker) UnsubscribeRaw(uri int32) {
+	i.raw.Delete(uri)
+}
+
+func (i *rtmInvoker) onRawEvent(uri int32, errCode int32, message []byte) error {
+	handler, ok := i.raw.Load(uri)
+	if !ok {
+		i.lg.Debug("no handler for raw event", zap.Int32("uri", uri))
+		return nil
+	}
+	handler.(RawEventHandler)(uri, errCode, message)
+	return nil
+}
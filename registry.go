@@ -0,0 +1,184 @@
+package rtm2_sdk
+
+import (
+	"fmt"
+	base "github.com/tomasliu-agora/rtm2-base"
+	"reflect"
+	"sync"
+)
+
+// Message is a protocol buffer carried in Header.Message: a request, a response or an event.
+type Message interface {
+	Marshalable
+	Unmarshal([]byte) error
+}
+
+// RawResponse is the reply to a uri registered without a response, whose body the SDK cannot decode.
+type RawResponse struct {
+	Uri     int32
+	ErrCode int32
+	Message []byte
+}
+
+// operation is what the SDK knows about a uri: the response decoding the body of its replies, or
+// the event it carries when the sidecar pushes it.
+type operation struct {
+	uri      int32
+	newResp  func() Message
+	newEvent func() Message
+	raw      bool // an event handed undecoded to the handlers of SubscribeRaw
+}
+
+// uriRegistry maps request types to uris and uris to their response or event, it replaces the type
+// switches each new operation used to be added to.
+type uriRegistry struct {
+	mu    sync.RWMutex
+	types map[reflect.Type]int32
+	ops   map[int32]*operation
+}
+
+var registry = &uriRegistry{types: make(map[reflect.Type]int32), ops: make(map[int32]*operation)}
+
+// RegisterRequest maps the type of req to uri, so that requests of this type can be sent. newResp decodes
+// the body of the replies, nil when they carry none. It fails when the type or the uri is taken already.
+func RegisterRequest(uri int32, req Message, newResp func() Message) error {
+	return registry.addRequest(uri, reflect.TypeOf(req), newResp)
+}
+
+// RegisterEvent maps uri to the event newEvent decodes, which is then handed to InvokeCallback.OnEvent.
+// It fails when the uri is taken already, unless only by SubscribeRaw.
+func RegisterEvent(uri int32, newEvent func() Message) error {
+	return registry.addEvent(uri, newEvent)
+}
+
+func (r *uriRegistry) addRequest(uri int32, t reflect.Type, newResp func() Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if other, ok := r.types[t]; ok {
+		return fmt.Errorf("request %v is registered with uri %d already", t, other)
+	}
+	if _, ok := r.ops[uri]; ok {
+		return fmt.Errorf("uri %d is registered already", uri)
+	}
+	r.types[t] = uri
+	r.ops[uri] = &operation{uri: uri, newResp: newResp}
+	return nil
+}
+
+// addEvent registers the event of uri, it takes over a uri subscribed raw so far.
+func (r *uriRegistry) addEvent(uri int32, newEvent func() Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if op, ok := r.ops[uri]; ok && !op.raw {
+		return fmt.Errorf("uri %d is registered already", uri)
+	}
+	r.ops[uri] = &operation{uri: uri, newEvent: newEvent}
+	return nil
+}
+
+// addRaw marks uri as an event delivered undecoded, any number of clients may subscribe to it.
+func (r *uriRegistry) addRaw(uri int32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if op, ok := r.ops[uri]; ok {
+		if op.raw {
+			return nil
+		}
+		return fmt.Errorf("uri %d is registered already", uri)
+	}
+	r.ops[uri] = &operation{uri: uri, raw: true}
+	return nil
+}
+
+// uriOf returns the uri of req, invalidUri for a type nobody registered.
+func (r *uriRegistry) uriOf(req interface{}) int32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if uri, ok := r.types[reflect.TypeOf(req)]; ok {
+		return uri
+	}
+	return invalidUri
+}
+
+func (r *uriRegistry) operation(uri int32) *operation {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ops[uri]
+}
+
+func (r *uriRegistry) isEvent(uri int32) bool {
+	op := r.operation(uri)
+	return op != nil && (op.newEvent != nil || op.raw)
+}
+
+func mustRegister(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func init() {
+	requests := []struct {
+		uri     int32
+		req     Message
+		newResp func() Message
+	}{
+		{UriLogin, &base.LoginReq{}, nil},
+		{UriLogout, &base.LogoutReq{}, nil},
+		{UriSetParam, &base.SetParamsReq{}, nil},
+		{UriRenewToken, &base.RenewTokenReq{}, nil},
+
+		{UriMessageSubscribe, &base.MessageSubReq{}, nil},
+		{UriMessageUnsubscribe, &base.MessageUnsubReq{}, nil},
+		{UriMessagePublish, &base.MessagePublishReq{}, nil},
+
+		{UriStreamJoin, &base.StreamJoinReq{}, nil},
+		{UriStreamLeave, &base.StreamLeaveReq{}, nil},
+		{UriStreamJoinTopic, &base.StreamJoinTopicReq{}, nil},
+		{UriStreamLeaveTopic, &base.StreamLeaveTopicReq{}, nil},
+		{UriStreamPublish, &base.StreamMessageReq{}, nil},
+		{UriStreamSubTopic, &base.StreamSubTopicReq{}, func() Message { return &base.StreamSubTopicResp{} }},
+		{UriStreamUnsubTopic, &base.StreamUnsubTopicReq{}, nil},
+
+		{UriStorageOpChannelMetaData, &base.StorageChannelReq{}, nil},
+		{UriStorageGetChannelMetaData, &base.StorageChannelGetReq{}, func() Message { return &base.StorageChannelGetResp{} }},
+		{UriStorageOpUserMetaData, &base.StorageUserReq{}, nil},
+		{UriStorageGetUserMetaData, &base.StorageUserGetReq{}, func() Message { return &base.StorageUserGetResp{} }},
+		{UriStorageSubscribeUserMetaData, &base.StorageUserSubReq{}, nil},
+		{UriStorageUnSubscribeUserMetaData, &base.StorageUserUnsubReq{}, nil},
+
+		{UriPresenceWhereNow, &base.PresenceWhereNowReq{}, func() Message { return &base.PresenceWhereNowResp{} }},
+		{UriPresenceWhoNow, &base.PresenceWhoNowReq{}, func() Message { return &base.PresenceWhoNowResp{} }},
+		{UriPresenceSetState, &base.PresenceSetStateReq{}, nil},
+		{UriPresenceGetState, &base.PresenceGetStateReq{}, func() Message { return &base.PresenceGetStateResp{} }},
+		{UriPresenceRemoveState, &base.PresenceRemoveStateReq{}, nil},
+
+		{UriLockAcquire, &base.LockAcquireReq{}, nil},
+		{UriLockGet, &base.LockGetReq{}, func() Message { return &base.LockGetResp{} }},
+		{UriLockRelease, &base.LockReleaseReq{}, nil},
+		{UriLockRemove, &base.LockRemoveReq{}, nil},
+		{UriLockRevoke, &base.LockRevokeReq{}, nil},
+		{UriLockSet, &base.LockSetReq{}, nil},
+	}
+	for _, r := range requests {
+		mustRegister(RegisterRequest(r.uri, r.req, r.newResp))
+	}
+
+	events := []struct {
+		uri      int32
+		newEvent func() Message
+	}{
+		{UriConnectStateChange, func() Message { return &base.ConnectionStateChangeEvent{} }},
+		{UriMessageEvent, func() Message { return &base.MessageEvent{} }},
+		{UriStreamEvent, func() Message { return &base.StreamMessageEvent{} }},
+		{UriStreamTopicEvent, func() Message { return &base.StreamTopicEvent{} }},
+		{UriStorageChannelEvent, func() Message { return &base.StorageChannelEvent{} }},
+		{UriStorageUserEvent, func() Message { return &base.StorageUserEvent{} }},
+		{UriPresenceEvent, func() Message { return &base.PresenceEvent{} }},
+		{UriLockEvent, func() Message { return &base.LockEvent{} }},
+		{UriTokenPrivilegeExpire, func() Message { return &base.TokenPrivilegeExpire{} }},
+	}
+	for _, e := range events {
+		mustRegister(RegisterEvent(e.uri, e.newEvent))
+	}
+}
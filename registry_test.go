@@ -0,0 +1,65 @@
+package rtm2_sdk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	base "github.com/tomasliu-agora/rtm2-base"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// localRequests are answered by the invoker without the sidecar, they need no uri.
+var localRequests = map[reflect.Type]bool{
+	reflect.TypeOf(&base.StreamSubListReq{}): true,
+}
+
+// baseRequests returns a value of every request type rtm2-base declares, from the protobuf registry.
+func baseRequests(t *testing.T) []interface{} {
+	var reqs []interface{}
+	protoregistry.GlobalTypes.RangeMessages(func(mt protoreflect.MessageType) bool {
+		name := string(mt.Descriptor().FullName())
+		if strings.HasPrefix(name, "base.") && strings.HasSuffix(name, "Req") {
+			typ := proto.MessageType(name)
+			if typ == nil {
+				t.Fatalf("no Go type for %s", name)
+			}
+			reqs = append(reqs, reflect.New(typ.Elem()).Interface())
+		}
+		return true
+	})
+	if len(reqs) == 0 {
+		t.Fatal("no request type found in rtm2-base")
+	}
+	return reqs
+}
+
+func TestEveryBaseRequestHasUri(t *testing.T) {
+	for _, req := range baseRequests(t) {
+		if localRequests[reflect.TypeOf(req)] {
+			continue
+		}
+		if uri := registry.uriOf(req); uri == invalidUri {
+			t.Errorf("%T has no uri", req)
+		}
+	}
+}
+
+func TestBaseRequestUrisAreDistinct(t *testing.T) {
+	seen := make(map[int32]interface{})
+	for _, req := range baseRequests(t) {
+		uri := registry.uriOf(req)
+		if uri == invalidUri {
+			continue
+		}
+		if IsEvent(uri) {
+			t.Errorf("%T is sent on the event uri %d", req, uri)
+		}
+		if other, ok := seen[uri]; ok {
+			t.Errorf("%T and %T share uri %d", req, other, uri)
+		}
+		seen[uri] = req
+	}
+}
@@ -0,0 +1,58 @@
+package rtm2_sdk
+
+import "time"
+
+const (
+	defaultRetries         = 2
+	defaultRetryBackoff    = time.Millisecond * 100
+	defaultRetryMaxBackoff = time.Second
+)
+
+// defaultRetryUris lists the reads that are safe to send again, a request whose reply was lost has no effect.
+var defaultRetryUris = map[int32]bool{
+	UriStorageGetChannelMetaData: true,
+	UriStorageGetUserMetaData:    true,
+	UriPresenceWhoNow:            true,
+	UriPresenceWhereNow:          true,
+	UriPresenceGetState:          true,
+	UriLockGet:                   true,
+}
+
+// retryPolicy decides whether a failed request is sent again. Only the uris it lists are retried,
+// on transient failures only, up to backoff.retries more attempts.
+type retryPolicy struct {
+	backoff backoff
+	uris    map[int32]bool
+}
+
+func newRetryPolicy() *retryPolicy {
+	p := &retryPolicy{backoff: defaultBackoff(), uris: make(map[int32]bool)}
+	p.backoff.retries = defaultRetries
+	p.backoff.initial = defaultRetryBackoff
+	p.backoff.max = defaultRetryMaxBackoff
+	for uri, retry := range defaultRetryUris {
+		p.uris[uri] = retry
+	}
+	return p
+}
+
+// apply reads the retry budget and backoff, and the uris of kParamRetryUris: true opts a uri in,
+// non-idempotent ones included, false opts it out.
+func (p *retryPolicy) apply(params map[string]interface{}) {
+	if retries := paramInt32(params, kParamRetries, int32(p.backoff.retries)); retries >= 0 {
+		p.backoff.retries = int(retries)
+	}
+	p.backoff.initial = paramMillis(params, kParamRetryBackoff, p.backoff.initial)
+	p.backoff.max = paramMillis(params, kParamRetryMaxBackoff, p.backoff.max)
+	if uris, ok := params[kParamRetryUris].(map[int32]bool); ok {
+		for uri, retry := range uris {
+			p.uris[uri] = retry
+		}
+	}
+}
+
+// allows reports whether the request of uri may be sent again after attempt failed with err.
+func (p *retryPolicy) allows(uri int32, err error, attempt int) bool {
+	// zero retries means none here, unlike the unlimited reconnect budget
+	return p.uris[uri] && p.backoff.retries > 0 && attempt <= p.backoff.retries && IsRetryable(err)
+}
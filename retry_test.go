@@ -0,0 +1,100 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	base "github.com/tomasliu-agora/rtm2-base"
+)
+
+// startRetryInvoker returns an invoker on s whose attempts at uri time out after 50ms and retry after 10ms.
+func startRetryInvoker(t *testing.T, s *fakeSidecar, uri int32, params map[string]interface{}) *rtmInvoker {
+	i := startInvoker(t, s.addr())
+	i.timeouts.uris[uri] = 50 * time.Millisecond
+	i.retries.backoff.initial = 10 * time.Millisecond
+	i.retries.backoff.max = 10 * time.Millisecond
+	i.retries.apply(params)
+	return i
+}
+
+func countOf(s *fakeSidecar, uri int32) int {
+	n := 0
+	for _, h := range s.requests() {
+		if h.Uri == uri {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      interface{}
+		uri      int32
+		params   map[string]interface{}
+		attempts int
+	}{
+		{"idempotent read up to the budget", &base.PresenceWhoNowReq{Channel: "ch"}, UriPresenceWhoNow, nil, 1 + defaultRetries},
+		{"larger budget", &base.PresenceWhoNowReq{Channel: "ch"}, UriPresenceWhoNow, map[string]interface{}{kParamRetries: int32(4)}, 5},
+		{"no budget", &base.PresenceWhoNowReq{Channel: "ch"}, UriPresenceWhoNow, map[string]interface{}{kParamRetries: int32(0)}, 1},
+		{"read opted out", &base.PresenceWhoNowReq{Channel: "ch"}, UriPresenceWhoNow, map[string]interface{}{kParamRetryUris: map[int32]bool{UriPresenceWhoNow: false}}, 1},
+		{"publish never", &base.MessagePublishReq{Channel: "ch"}, UriMessagePublish, nil, 1},
+		{"publish opted in", &base.MessagePublishReq{Channel: "ch"}, UriMessagePublish, map[string]interface{}{kParamRetryUris: map[int32]bool{UriMessagePublish: true}}, 1 + defaultRetries},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeSidecar(t, nil) // every attempt times out
+			i := startRetryInvoker(t, s, tt.uri, tt.params)
+
+			_, code, err := i.OnReceivedContext(context.Background(), tt.req)
+			var reqErr *RequestError
+			if !errors.As(err, &reqErr) || code != ErrCodeTimeout || !errors.Is(err, ERR_TIMEOUT) {
+				t.Fatalf("got %d %v, want a timeout RequestError", code, err)
+			}
+			if reqErr.Attempts != tt.attempts || reqErr.Uri != tt.uri {
+				t.Fatalf("got %d attempts of uri %d, want %d of uri %d", reqErr.Attempts, reqErr.Uri, tt.attempts, tt.uri)
+			}
+			if n := countOf(s, tt.uri); n != tt.attempts {
+				t.Fatalf("the sidecar got %d requests, want %d", n, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryStopsOnPermanentError(t *testing.T) {
+	s := newFakeSidecar(t, func(h *Header) *Header {
+		return &Header{Uri: h.Uri, SeqId: h.SeqId, ErrCode: 10011} // ERR_NOT_LOGIN
+	})
+	i := startRetryInvoker(t, s, UriPresenceWhoNow, nil)
+
+	_, _, err := i.OnReceivedContext(context.Background(), &base.PresenceWhoNowReq{Channel: "ch"})
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || reqErr.Code != 10011 || reqErr.Attempts != 1 {
+		t.Fatalf("got %v, want ERR_NOT_LOGIN after 1 attempt", err)
+	}
+	if n := countOf(s, UriPresenceWhoNow); n != 1 {
+		t.Fatalf("the sidecar got %d requests, want 1", n)
+	}
+}
+
+func TestRetrySucceedsAfterTransientError(t *testing.T) {
+	var calls int32
+	s := newFakeSidecar(t, func(h *Header) *Header {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return &Header{Uri: h.Uri, SeqId: h.SeqId, ErrCode: 10301} // ERR_PRESENCE_SERVICE_NOT_READY
+		}
+		return echo(h)
+	})
+	i := startRetryInvoker(t, s, UriPresenceWhoNow, nil)
+
+	if _, _, err := i.OnReceivedContext(context.Background(), &base.PresenceWhoNowReq{Channel: "ch"}); err != nil {
+		t.Fatalf("got %v after a transient error", err)
+	}
+	if n := countOf(s, UriPresenceWhoNow); n != 2 {
+		t.Fatalf("the sidecar got %d requests, want 2", n)
+	}
+}
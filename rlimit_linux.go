@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package rtm2_sdk
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+var rlimitResources = map[string]int{
+	"as":      unix.RLIMIT_AS,
+	"core":    unix.RLIMIT_CORE,
+	"cpu":     unix.RLIMIT_CPU,
+	"data":    unix.RLIMIT_DATA,
+	"fsize":   unix.RLIMIT_FSIZE,
+	"nofile":  unix.RLIMIT_NOFILE,
+	"stack":   unix.RLIMIT_STACK,
+	"nproc":   unix.RLIMIT_NPROC,
+	"memlock": unix.RLIMIT_MEMLOCK,
+}
+
+// setRlimits applies the limits to a running process with prlimit(2), soft and hard limits alike.
+// Go cannot set them between fork and exec, so the process has already been running without them
+// for as long as it took Start to return.
+func setRlimits(pid int, limits map[string]uint64) error {
+	for name, value := range limits {
+		resource, ok := rlimitResources[name]
+		if !ok {
+			return fmt.Errorf("unknown resource limit %q", name)
+		}
+		limit := unix.Rlimit{Cur: value, Max: value}
+		if err := unix.Prlimit(pid, resource, &limit, nil); err != nil {
+			return fmt.Errorf("set resource limit %q: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package rtm2_sdk
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSetRlimits(t *testing.T) {
+	p := exec.Command("sleep", "10")
+	if err := p.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer func() {
+		_ = p.Process.Kill()
+		_ = p.Wait()
+	}()
+	if err := setRlimits(p.Process.Pid, map[string]uint64{"nofile": 64, "memlock": 1 << 16}); err != nil {
+		t.Fatal(err)
+	}
+	limits, err := os.ReadFile("/proc/" + strconv.Itoa(p.Process.Pid) + "/limits")
+	if err != nil {
+		t.Skip(err)
+	}
+	for name, want := range map[string]string{"Max open files": "64", "Max locked memory": "65536"} {
+		var fields []string
+		for _, line := range strings.Split(string(limits), "\n") {
+			if strings.HasPrefix(line, name) {
+				fields = strings.Fields(strings.TrimPrefix(line, name))
+			}
+		}
+		if len(fields) < 2 || fields[0] != want || fields[1] != want {
+			t.Fatalf("%s: got %v, want %s", name, fields, want)
+		}
+	}
+	if err := setRlimits(p.Process.Pid, map[string]uint64{"bogus": 1}); err == nil {
+		t.Fatal("unknown resource accepted")
+	}
+}
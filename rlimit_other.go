@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package rtm2_sdk
+
+import "errors"
+
+func setRlimits(pid int, limits map[string]uint64) error {
+	if len(limits) == 0 {
+		return nil
+	}
+	return errors.New("resource limits are only supported on linux")
+}
@@ -0,0 +1,193 @@
+package rtm2_sdk
+
+import (
+	"encoding/json"
+	base "github.com/tomasliu-agora/rtm2-base"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// session records the successful requests that shape the state kept by the sidecar,
+// so that a restarted sidecar can be brought back to it by replaying them.
+type session struct {
+	mu     sync.Mutex
+	login  *base.LoginReq
+	params map[string]interface{}
+	keys   []string
+	reqs   map[string]interface{}
+	subs   map[string]map[string]struct{}
+}
+
+func newSession() *session {
+	return &session{params: make(map[string]interface{}), reqs: make(map[string]interface{}), subs: make(map[string]map[string]struct{})}
+}
+
+func streamKey(channel string) string {
+	return "stream/" + channel
+}
+
+func topicKey(channel, topic string) string {
+	return "topic/" + channel + "/" + topic
+}
+
+func subKey(channel, topic string) string {
+	return "sub/" + channel + "/" + topic
+}
+
+// record updates the journal with a request the sidecar has accepted and its decoded response.
+func (s *session) record(req interface{}, resp interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r := req.(type) {
+	case *base.LoginReq:
+		login := *r
+		s.login = &login
+	case *base.LogoutReq:
+		s.login = nil
+		s.keys = nil
+		s.reqs = make(map[string]interface{})
+		s.subs = make(map[string]map[string]struct{})
+	case *base.RenewTokenReq:
+		if r.Channel == "" {
+			if s.login != nil {
+				s.login.Token = r.Token
+			}
+		} else if join, ok := s.reqs[streamKey(r.Channel)].(*base.StreamJoinReq); ok {
+			join.Token = r.Token
+		}
+	case *base.SetParamsReq:
+		params := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(r.Params), &params); err == nil {
+			for key, value := range params {
+				s.params[key] = value
+			}
+		}
+	case *base.MessageSubReq:
+		sub := *r
+		s.put("message/"+r.Channel, &sub)
+	case *base.MessageUnsubReq:
+		s.remove("message/" + r.Channel)
+	case *base.StreamJoinReq:
+		join := *r
+		s.put(streamKey(r.Channel), &join)
+	case *base.StreamLeaveReq:
+		s.remove(streamKey(r.Channel))
+		s.removePrefix(topicKey(r.Channel, ""))
+		s.removePrefix(subKey(r.Channel, ""))
+	case *base.StreamJoinTopicReq:
+		join := *r
+		s.put(topicKey(r.Channel, r.Topic), &join)
+	case *base.StreamLeaveTopicReq:
+		s.remove(topicKey(r.Channel, r.Topic))
+		s.remove(subKey(r.Channel, r.Topic))
+	case *base.StreamSubTopicReq:
+		// the sidecar may take some of the users only, the others are not subscribed
+		var succeed []string
+		if sub, ok := resp.(*base.StreamSubTopicResp); ok {
+			succeed = sub.GetSucceed()
+		}
+		key := subKey(r.Channel, r.Topic)
+		users, ok := s.subs[key]
+		if !ok {
+			// no user listed subscribes the whole topic
+			if len(r.UserIds) != 0 && len(succeed) == 0 {
+				return
+			}
+			users = make(map[string]struct{})
+			s.put(key, &base.StreamSubTopicReq{Channel: r.Channel, Topic: r.Topic})
+			s.subs[key] = users
+		}
+		for _, user := range succeed {
+			users[user] = struct{}{}
+		}
+	case *base.StreamUnsubTopicReq:
+		key := subKey(r.Channel, r.Topic)
+		if len(r.UserIds) == 0 {
+			// no user listed unsubscribes the whole topic
+			s.remove(key)
+		} else if users, ok := s.subs[key]; ok {
+			for _, user := range r.UserIds {
+				delete(users, user)
+			}
+			if len(users) == 0 {
+				s.remove(key)
+			}
+		}
+	case *base.StorageUserSubReq:
+		sub := *r
+		s.put("storage/"+r.UserId, &sub)
+	case *base.StorageUserUnsubReq:
+		s.remove("storage/" + r.UserId)
+	}
+}
+
+// subscribedUsers returns the users subscribed in a topic, sorted.
+func (s *session) subscribedUsers(channel, topic string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]string, 0, len(s.subs[subKey(channel, topic)]))
+	for user := range s.subs[subKey(channel, topic)] {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+func (s *session) put(key string, req interface{}) {
+	if _, ok := s.reqs[key]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.reqs[key] = req
+}
+
+func (s *session) remove(key string) {
+	if _, ok := s.reqs[key]; !ok {
+		return
+	}
+	delete(s.reqs, key)
+	delete(s.subs, key)
+	for idx, k := range s.keys {
+		if k == key {
+			s.keys = append(s.keys[:idx], s.keys[idx+1:]...)
+			break
+		}
+	}
+}
+
+func (s *session) removePrefix(prefix string) {
+	for _, key := range append([]string(nil), s.keys...) {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(key)
+		}
+	}
+}
+
+// replay returns the requests restoring the session in order, login first, nil when not logged in.
+func (s *session) replay() []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.login == nil {
+		return nil
+	}
+	login := *s.login
+	ret := []interface{}{&login}
+	if len(s.params) != 0 {
+		if params, err := json.Marshal(s.params); err == nil {
+			ret = append(ret, &base.SetParamsReq{Params: string(params)})
+		}
+	}
+	for _, key := range s.keys {
+		req := s.reqs[key]
+		if sub, ok := req.(*base.StreamSubTopicReq); ok {
+			users := make([]string, 0, len(s.subs[key]))
+			for user := range s.subs[key] {
+				users = append(users, user)
+			}
+			sort.Strings(users)
+			req = &base.StreamSubTopicReq{Channel: sub.Channel, Topic: sub.Topic, UserIds: users}
+		}
+		ret = append(ret, req)
+	}
+	return ret
+}
@@ -0,0 +1,170 @@
+package rtm2_sdk
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	base "github.com/tomasliu-agora/rtm2-base"
+)
+
+type sessionStep struct {
+	req  interface{}
+	resp interface{}
+}
+
+func subTopic(topic string, users ...string) sessionStep {
+	return sessionStep{&base.StreamSubTopicReq{Channel: "ch", Topic: topic, UserIds: users},
+		&base.StreamSubTopicResp{Channel: "ch", Topic: topic, Succeed: users}}
+}
+
+func step(req interface{}) sessionStep {
+	return sessionStep{req: req}
+}
+
+func TestSessionReplay(t *testing.T) {
+	login := step(&base.LoginReq{Token: "token"})
+	cases := []struct {
+		name  string
+		steps []sessionStep
+		want  []interface{}
+	}{
+		{"not logged in", []sessionStep{step(&base.MessageSubReq{Channel: "ch"})}, nil},
+		{"login only", []sessionStep{login}, []interface{}{&base.LoginReq{Token: "token"}}},
+		{"logout clears everything", []sessionStep{login, step(&base.MessageSubReq{Channel: "ch"}), step(&base.LogoutReq{})}, nil},
+		{"renewed tokens", []sessionStep{
+			login,
+			step(&base.StreamJoinReq{Channel: "ch", Token: "old"}),
+			step(&base.RenewTokenReq{Token: "new"}),
+			step(&base.RenewTokenReq{Channel: "ch", Token: "stream"}),
+		}, []interface{}{
+			&base.LoginReq{Token: "new"},
+			&base.StreamJoinReq{Channel: "ch", Token: "stream"},
+		}},
+		{"parameters merged", []sessionStep{
+			login,
+			step(&base.SetParamsReq{Params: `{"a":1}`}),
+			step(&base.SetParamsReq{Params: `{"b":2}`}),
+		}, []interface{}{
+			&base.LoginReq{Token: "token"},
+			&base.SetParamsReq{Params: `{"a":1,"b":2}`},
+		}},
+		{"subscriptions in order", []sessionStep{
+			login,
+			step(&base.StorageUserSubReq{UserId: "u"}),
+			step(&base.MessageSubReq{Channel: "ch"}),
+			step(&base.StreamJoinReq{Channel: "ch"}),
+			step(&base.StreamJoinTopicReq{Channel: "ch", Topic: "t"}),
+			subTopic("t", "b"),
+			subTopic("t", "a"),
+		}, []interface{}{
+			&base.LoginReq{Token: "token"},
+			&base.StorageUserSubReq{UserId: "u"},
+			&base.MessageSubReq{Channel: "ch"},
+			&base.StreamJoinReq{Channel: "ch"},
+			&base.StreamJoinTopicReq{Channel: "ch", Topic: "t"},
+			&base.StreamSubTopicReq{Channel: "ch", Topic: "t", UserIds: []string{"a", "b"}},
+		}},
+		{"unsubscribed", []sessionStep{
+			login,
+			step(&base.MessageSubReq{Channel: "ch"}),
+			step(&base.StorageUserSubReq{UserId: "u"}),
+			step(&base.MessageUnsubReq{Channel: "ch"}),
+			step(&base.StorageUserUnsubReq{UserId: "u"}),
+		}, []interface{}{&base.LoginReq{Token: "token"}}},
+		{"some users unsubscribed", []sessionStep{
+			login,
+			subTopic("t", "a", "b"),
+			step(&base.StreamUnsubTopicReq{Channel: "ch", Topic: "t", UserIds: []string{"a"}}),
+		}, []interface{}{
+			&base.LoginReq{Token: "token"},
+			&base.StreamSubTopicReq{Channel: "ch", Topic: "t", UserIds: []string{"b"}},
+		}},
+		{"whole topic unsubscribed", []sessionStep{
+			login,
+			subTopic("t", "a", "b"),
+			step(&base.StreamUnsubTopicReq{Channel: "ch", Topic: "t"}),
+		}, []interface{}{&base.LoginReq{Token: "token"}}},
+		{"whole topic subscribed", []sessionStep{login, subTopic("t")}, []interface{}{
+			&base.LoginReq{Token: "token"},
+			&base.StreamSubTopicReq{Channel: "ch", Topic: "t", UserIds: []string{}},
+		}},
+		{"failed users left out", []sessionStep{
+			login,
+			{&base.StreamSubTopicReq{Channel: "ch", Topic: "t", UserIds: []string{"a", "b"}},
+				&base.StreamSubTopicResp{Channel: "ch", Topic: "t", Succeed: []string{"b"}, Failed: []string{"a"}}},
+			{&base.StreamSubTopicReq{Channel: "ch", Topic: "u", UserIds: []string{"c"}},
+				&base.StreamSubTopicResp{Channel: "ch", Topic: "u", Failed: []string{"c"}}},
+		}, []interface{}{
+			&base.LoginReq{Token: "token"},
+			&base.StreamSubTopicReq{Channel: "ch", Topic: "t", UserIds: []string{"b"}},
+		}},
+		{"topic left", []sessionStep{
+			login,
+			step(&base.StreamJoinReq{Channel: "ch"}),
+			step(&base.StreamJoinTopicReq{Channel: "ch", Topic: "t"}),
+			subTopic("t", "a"),
+			step(&base.StreamLeaveTopicReq{Channel: "ch", Topic: "t"}),
+		}, []interface{}{
+			&base.LoginReq{Token: "token"},
+			&base.StreamJoinReq{Channel: "ch"},
+		}},
+		{"stream left", []sessionStep{
+			login,
+			step(&base.StreamJoinReq{Channel: "ch"}),
+			step(&base.StreamJoinReq{Channel: "other"}),
+			step(&base.StreamJoinTopicReq{Channel: "ch", Topic: "t"}),
+			subTopic("t", "a"),
+			step(&base.StreamLeaveReq{Channel: "ch"}),
+		}, []interface{}{
+			&base.LoginReq{Token: "token"},
+			&base.StreamJoinReq{Channel: "other"},
+		}},
+		{"joined again", []sessionStep{
+			login,
+			step(&base.MessageSubReq{Channel: "a"}),
+			step(&base.MessageSubReq{Channel: "b"}),
+			step(&base.MessageUnsubReq{Channel: "a"}),
+			step(&base.MessageSubReq{Channel: "a"}),
+		}, []interface{}{
+			&base.LoginReq{Token: "token"},
+			&base.MessageSubReq{Channel: "b"},
+			&base.MessageSubReq{Channel: "a"},
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newSession()
+			for _, step := range tc.steps {
+				s.record(step.req, step.resp)
+			}
+			got := s.replay()
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d requests %v, want %d", len(got), describe(got), len(tc.want))
+			}
+			for k := range got {
+				if !reflect.DeepEqual(got[k], tc.want[k]) {
+					t.Fatalf("request %d: got %s, want %s", k, describe(got[k:k+1]), describe(tc.want[k:k+1]))
+				}
+			}
+		})
+	}
+}
+
+func TestSessionRecordsCopies(t *testing.T) {
+	s := newSession()
+	login := &base.LoginReq{Token: "token"}
+	s.record(login, nil)
+	login.Token = "changed"
+	if got := s.replay()[0].(*base.LoginReq).Token; got != "token" {
+		t.Fatalf("the journal follows the caller's request, got token %s", got)
+	}
+}
+
+func describe(reqs []interface{}) string {
+	ret := ""
+	for _, req := range reqs {
+		ret += fmt.Sprintf("%T%+v ", req, req)
+	}
+	return ret
+}
@@ -0,0 +1,221 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// sharedSidecars holds the sidecars shared by the clients of this process, by golang_sidecar_shared.
+var sharedSidecars = struct {
+	sync.Mutex
+	groups map[string]*sharedSidecar
+}{groups: make(map[string]*sharedSidecar)}
+
+// sharedSidecar is one sidecar process and one connection serving several clients.
+// Every client is given a ConnIndex, set on its requests and used by the sidecar to tag the events
+// it pushes, so that the connection routes them back to the right invoker. Replies are matched by SeqId
+// which is unique on the connection already.
+type sharedSidecar struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	group  string
+
+	sidecar *rtmSidecar
+	conn    *connectionPool
+	// ready is closed once the sidecar is started, err tells whether it failed
+	ready chan struct{}
+	err   error
+	once  sync.Once
+
+	mu      sync.Mutex
+	members map[uint64]*rtmInvoker
+	index   uint64
+	closed  bool
+
+	lg *zap.Logger
+}
+
+// acquireShared attaches i to the sidecar of group, spawning it with params for the first client
+// unless golang_sidecar_endpoint points to a running one.
+// The sidecar lives on until its last client detaches, whatever the context of the client creating it.
+// sharedSidecars is only held to look the group up, a sidecar getting ready holds back the clients
+// of its own group only.
+func acquireShared(group string, i *rtmInvoker, params map[string]interface{}) (*sharedSidecar, uint64, error) {
+	for {
+		s, created := sharedGroup(group, i.lg)
+		if created {
+			s.start(params)
+		}
+		select {
+		case <-s.ready:
+		case <-i.ctx.Done():
+			return nil, 0, i.ctx.Err()
+		}
+		if s.err != nil {
+			return nil, 0, s.err
+		}
+		if index, ok := s.attach(i); ok {
+			return s, index, nil
+		}
+		// the last client detached meanwhile, wait for the group to be dropped and spawn a new sidecar
+		<-s.ctx.Done()
+	}
+}
+
+// sharedGroup returns the sidecar of group, a new one when there is none, which the caller starts.
+func sharedGroup(group string, lg *zap.Logger) (*sharedSidecar, bool) {
+	sharedSidecars.Lock()
+	defer sharedSidecars.Unlock()
+	if s, ok := sharedSidecars.groups[group]; ok {
+		return s, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &sharedSidecar{ctx: ctx, cancel: cancel, group: group, ready: make(chan struct{}),
+		members: make(map[uint64]*rtmInvoker), lg: lg.With(zap.String("group", group))}
+	sharedSidecars.groups[group] = s
+	return s, true
+}
+
+// start connects to golang_sidecar_endpoint or spawns the sidecar and waits for it to listen.
+func (s *sharedSidecar) start(params map[string]interface{}) {
+	defer close(s.ready)
+	if endpoint, ok := params[kParamSidecarEndpoint].(string); ok {
+		s.conn = newConnectionPool(s.ctx, s.lg, endpoint, connectionsFromParams(params), connectionConfigFromParams(params), s)
+		go s.loop(nil)
+		s.conn.Start()
+		return
+	}
+	sidecar, err := createSidecar(s.ctx, s.lg, sidecarConfigFromParams(params))
+	if err != nil {
+		s.err = err
+		s.close()
+		return
+	}
+	s.sidecar = sidecar
+	errChan := sidecar.Start()
+	if _, err := sidecar.WaitReady(s.ctx); err != nil {
+		s.lg.Error("sidecar is not ready", zap.Error(err))
+	}
+	s.conn = newConnectionPool(s.ctx, s.lg, sidecar.Endpoint(), connectionsFromParams(params), spawnedConnectionConfig(params), s)
+	go s.loop(errChan)
+	s.conn.Start()
+}
+
+// attach gives i an index, it fails once the sidecar is closing.
+func (s *sharedSidecar) attach(i *rtmInvoker) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, false
+	}
+	// zero stays the index of an unshared connection
+	s.index++
+	s.members[s.index] = i
+	s.conn.Route(s.index, i)
+	s.lg.Info("client attached", zap.Uint64("index", s.index), zap.Int("clients", len(s.members)))
+	return s.index, true
+}
+
+// release detaches the client at index, the last one out stops the sidecar. Releasing twice is harmless.
+func (s *sharedSidecar) release(index uint64) {
+	s.mu.Lock()
+	if _, ok := s.members[index]; !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.members, index)
+	s.conn.Route(index, nil)
+	left := len(s.members)
+	if left == 0 {
+		s.closed = true
+	}
+	s.mu.Unlock()
+	s.lg.Info("client detached", zap.Uint64("index", index), zap.Int("clients", left))
+	if left == 0 {
+		s.close()
+	}
+}
+
+// close drops the group and stops the sidecar, the first call only. The sidecar is stopped
+// outside sharedSidecars, a new one for the group may be spawned meanwhile.
+func (s *sharedSidecar) close() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		sharedSidecars.Lock()
+		if sharedSidecars.groups[s.group] == s {
+			delete(sharedSidecars.groups, s.group)
+		}
+		sharedSidecars.Unlock()
+		s.cancel()
+		if err := s.sidecar.Stop(context.Background()); err != nil {
+			s.lg.Error("failed to stop sidecar", zap.Error(err))
+		}
+	})
+}
+
+func (s *sharedSidecar) clients() []*rtmInvoker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]*rtmInvoker, 0, len(s.members))
+	for _, i := range s.members {
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+// onResponse receives the events tagged with an index no client is attached to.
+func (s *sharedSidecar) onResponse(uri int32, errCode int32, message []byte) error {
+	s.lg.Warn("event for a detached client", zap.Int32("uri", uri), zap.Int32("errCode", errCode))
+	return nil
+}
+
+// loop is the shared counterpart of rtmInvoker.loop: a restarted sidecar restores every client,
+// a fatal error is reported to all of them and the group is dropped, the next login spawns a new sidecar.
+func (s *sharedSidecar) loop(errChan <-chan error) {
+	var err error
+	defer func() {
+		if err != nil {
+			for _, i := range s.clients() {
+				i.report(err)
+			}
+		}
+		s.close()
+	}()
+	var ready <-chan int
+	var reconnected <-chan struct{}
+	if s.sidecar != nil {
+		ready = s.sidecar.Ready()
+	} else {
+		// a sidecar given by golang_sidecar_endpoint may have been restarted behind a lost link
+		reconnected = s.conn.Reconnected()
+	}
+	reconnects := 1
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case err = <-errChan:
+			s.lg.Info("sidecar error", zap.Error(err))
+			return
+		case err = <-s.conn.ErrorChan():
+			s.lg.Info("connection error", zap.Error(err))
+			return
+		case gen := <-ready:
+			s.conn.SetEndpoint(s.sidecar.Endpoint())
+			s.conn.Redial()
+			if gen > 1 {
+				for _, i := range s.clients() {
+					go i.restore(gen)
+				}
+			}
+		case <-reconnected:
+			reconnects++
+			for _, i := range s.clients() {
+				go i.restore(reconnects)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package rtm2_sdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	base "github.com/tomasliu-agora/rtm2-base"
+	"go.uber.org/zap"
+)
+
+// eventsOf collects the events handed to an invoker.
+type eventsOf chan interface{}
+
+func (e eventsOf) OnEvent(event interface{}) {
+	e <- event
+}
+
+// joinShared attaches a new invoker to group, as PreLogin does for golang_sidecar_shared.
+func joinShared(t *testing.T, group string, params map[string]interface{}) (*rtmInvoker, eventsOf) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	callback := make(eventsOf, 16)
+	i := &rtmInvoker{ctx: ctx, cancel: cancel, lg: zap.NewNop(), callback: callback, timeouts: newRequestTimeouts(), retries: newRetryPolicy(), session: newSession()}
+	shared, index, err := acquireShared(group, i, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.shared, i.index, i.conn = shared, index, shared.conn
+	t.Cleanup(func() { shared.release(index) })
+	return i, callback
+}
+
+func sharedGroupExists(group string) bool {
+	sharedSidecars.Lock()
+	defer sharedSidecars.Unlock()
+	_, ok := sharedSidecars.groups[group]
+	return ok
+}
+
+func messageEvent(t *testing.T, index uint64, channel string) *Header {
+	message, err := (&base.MessageEvent{Channel: channel}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Header{Uri: UriMessageEvent, ConnIndex: index, Message: message}
+}
+
+func TestSharedRoutesEventsByConnIndex(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	params := map[string]interface{}{kParamSidecarEndpoint: s.addr()}
+	a, eventsA := joinShared(t, "routing", params)
+	b, eventsB := joinShared(t, "routing", params)
+	if a.conn != b.conn || a.index == b.index {
+		t.Fatalf("clients on links %p and %p with indexes %d and %d", a.conn, b.conn, a.index, b.index)
+	}
+	if _, err := roundTrip(t, a.conn.conns[0], UriPresenceWhoNow, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	s.push(messageEvent(t, b.index, "b"), messageEvent(t, a.index, "a"), messageEvent(t, b.index+1, "nobody"))
+	for _, tc := range []struct {
+		events  eventsOf
+		channel string
+	}{{eventsA, "a"}, {eventsB, "b"}} {
+		select {
+		case event := <-tc.events:
+			if got := event.(*base.MessageEvent).Channel; got != tc.channel {
+				t.Fatalf("got the event of channel %s, want %s", got, tc.channel)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for channel %s", tc.channel)
+		}
+	}
+	select {
+	case event := <-eventsA:
+		t.Fatalf("unexpected event %v", event)
+	case event := <-eventsB:
+		t.Fatalf("unexpected event %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSharedReleasedWhenClientIsDone(t *testing.T) {
+	s := newFakeSidecar(t, echo)
+	params := map[string]interface{}{kParamSidecarEndpoint: s.addr()}
+	a, _ := joinShared(t, "done", params)
+	b, _ := joinShared(t, "done", params)
+	shared := a.shared
+
+	// as the watcher started by PreLogin
+	for _, i := range []*rtmInvoker{a, b} {
+		go func(i *rtmInvoker) {
+			<-i.ctx.Done()
+			i.shared.release(i.index)
+		}(i)
+	}
+	a.cancel()
+	waitFor(t, time.Second, func() bool { return len(shared.clients()) == 1 })
+	if !sharedGroupExists("done") {
+		t.Fatal("group dropped while a client is attached")
+	}
+	b.cancel()
+	waitFor(t, time.Second, func() bool { return !sharedGroupExists("done") })
+	if shared.ctx.Err() == nil {
+		t.Fatal("sidecar left running")
+	}
+	// a release after the watcher's is harmless
+	b.shared.release(b.index)
+
+	c, _ := joinShared(t, "done", params)
+	if c.shared == shared {
+		t.Fatal("attached to a closed sidecar")
+	}
+}
+
+func TestSharedStartDoesNotHoldOtherGroups(t *testing.T) {
+	// a sidecar of group slow getting ready, as long as the test wants
+	slow, created := sharedGroup("slow", zap.NewNop())
+	if !created {
+		t.Fatal("group slow exists already")
+	}
+	defer func() {
+		slow.err = ERR_DISCONNECTED
+		close(slow.ready)
+		slow.close()
+	}()
+
+	s := newFakeSidecar(t, echo)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		i := &rtmInvoker{ctx: context.Background(), lg: zap.NewNop()}
+		shared, index, err := acquireShared("fast", i, map[string]interface{}{kParamSidecarEndpoint: s.addr()})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		shared.release(index)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("attaching to another group waits for the slow sidecar")
+	}
+
+	// a client of the slow group gives up with its context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	i := &rtmInvoker{ctx: ctx, cancel: cancel, lg: zap.NewNop()}
+	if _, _, err := acquireShared("slow", i, nil); err != context.Canceled {
+		t.Fatalf("got %v, want the context error", err)
+	}
+}
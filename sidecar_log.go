@@ -0,0 +1,177 @@
+package rtm2_sdk
+
+import (
+	"bytes"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSidecarLogRate = 200
+const maxSidecarLogLine = 64 * 1024
+
+// logTail keeps the last lines written by the sidecar, to be attached to its exit error.
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLogTail(size int) *logTail {
+	if size <= 0 {
+		return nil
+	}
+	return &logTail{lines: make([]string, size)}
+}
+
+func (t *logTail) add(line string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+	if t.next == 0 {
+		t.full = true
+	}
+}
+
+func (t *logTail) snapshot() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.full {
+		return append([]string(nil), t.lines[:t.next]...)
+	}
+	return append(append([]string(nil), t.lines[t.next:]...), t.lines[:t.next]...)
+}
+
+// logLimiter allows up to rate lines per second, rate zero or less means unlimited.
+type logLimiter struct {
+	mu         sync.Mutex
+	rate       int
+	window     time.Time
+	count      int
+	suppressed int
+}
+
+// allow reports whether a line may be logged, along with the lines suppressed in the previous window.
+func (l *logLimiter) allow(now time.Time) (bool, int) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	suppressed := 0
+	if now.Sub(l.window) >= time.Second {
+		suppressed = l.suppressed
+		l.window = now
+		l.count = 0
+		l.suppressed = 0
+	}
+	if l.count >= l.rate {
+		l.suppressed++
+		return false, suppressed
+	}
+	l.count++
+	return true, suppressed
+}
+
+// sidecarLogWriter splits the output of the sidecar into lines and logs each of them.
+type sidecarLogWriter struct {
+	lg      *zap.Logger
+	level   zapcore.Level
+	limiter *logLimiter
+	tail    *logTail
+	buf     []byte
+}
+
+func newSidecarLogWriter(lg *zap.Logger, stream string, level zapcore.Level, limiter *logLimiter, tail *logTail) *sidecarLogWriter {
+	// the caller would always point here, it says nothing about the sidecar
+	return &sidecarLogWriter{lg: lg.With(zap.String("stream", stream)).WithOptions(zap.WithCaller(false)), level: level, limiter: limiter, tail: tail}
+}
+
+func (w *sidecarLogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		w.line(string(bytes.TrimRight(w.buf[:idx], "\r")))
+		w.buf = w.buf[idx+1:]
+	}
+	if len(w.buf) > maxSidecarLogLine {
+		w.flush()
+	}
+	return len(p), nil
+}
+
+// flush logs a trailing partial line.
+func (w *sidecarLogWriter) flush() {
+	if len(w.buf) != 0 {
+		w.line(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *sidecarLogWriter) line(line string) {
+	if len(line) == 0 {
+		return
+	}
+	w.tail.add(line)
+	allowed, suppressed := w.limiter.allow(time.Now())
+	if suppressed > 0 {
+		w.lg.Warn("sidecar log lines suppressed", zap.Int("count", suppressed))
+	}
+	if !allowed {
+		return
+	}
+	if ce := w.lg.Check(detectLevel(line, w.level), line); ce != nil {
+		ce.Write()
+	}
+}
+
+// detectLevel looks for the level the C++ sidecar writes at the head of its lines, like "[ERROR]" or "E0101".
+func detectLevel(line string, def zapcore.Level) zapcore.Level {
+	head := line
+	if len(head) > 40 {
+		head = head[:40]
+	}
+	head = strings.ToUpper(head)
+	switch {
+	case strings.Contains(head, "FATAL"), strings.Contains(head, "CRITICAL"), strings.Contains(head, "ERROR"),
+		strings.Contains(head, "[E]"), strings.HasPrefix(head, "E0"), strings.HasPrefix(head, "E1"):
+		return zapcore.ErrorLevel
+	case strings.Contains(head, "WARN"), strings.Contains(head, "[W]"), strings.HasPrefix(head, "W0"), strings.HasPrefix(head, "W1"):
+		return zapcore.WarnLevel
+	case strings.Contains(head, "INFO"), strings.Contains(head, "[I]"), strings.HasPrefix(head, "I0"), strings.HasPrefix(head, "I1"):
+		return zapcore.InfoLevel
+	case strings.Contains(head, "DEBUG"), strings.Contains(head, "TRACE"), strings.Contains(head, "VERBOSE"), strings.Contains(head, "[D]"):
+		return zapcore.DebugLevel
+	}
+	return def
+}
+
+// SidecarExitError is reported when the sidecar dies, carrying the last lines it wrote when golang_sidecar_log_tail is set.
+type SidecarExitError struct {
+	Err  error
+	Tail []string
+}
+
+func (e *SidecarExitError) Error() string {
+	if len(e.Tail) == 0 {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + ", last output:\n" + strings.Join(e.Tail, "\n")
+}
+
+func (e *SidecarExitError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,238 @@
+// Package sidecartest provides an in-process stand-in for rtm2-wrapper.exe.
+//
+// The Server speaks the same framing as the SDK, so a client pointed at it through the
+// golang_sidecar_endpoint parameter can be exercised without the C++ sidecar:
+//
+//	srv, _ := sidecartest.NewServer()
+//	defer srv.Close()
+//	srv.Handle(rtm2_sdk.UriPresenceWhoNow, func(uri int32, message []byte) ([]byte, int32, error) {
+//		body, err := (&base.PresenceWhoNowResp{}).Marshal()
+//		return body, 0, err
+//	})
+//	client.SetParameters(map[string]interface{}{"golang_sidecar_endpoint": srv.Addr()})
+package sidecartest
+
+import (
+	"bufio"
+	"errors"
+	rtm2_sdk "github.com/tomasliu-agora/rtm2-sdk"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const serviceId = 2380
+
+// NoReply can be returned by a Handler to leave the request unanswered.
+var NoReply = errors.New("sidecartest: no reply")
+
+// Handler answers a request with the reply message and its error code.
+type Handler func(uri int32, message []byte) ([]byte, int32, error)
+
+type Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	handlers map[int32]Handler
+	delays   map[int32]time.Duration
+	counts   map[int32]int
+	conns    map[net.Conn]*sync.Mutex
+	refuse   bool
+	closed   bool
+}
+
+// NewServer listens on a random local port.
+func NewServer() (*Server, error) {
+	return Listen("tcp", "127.0.0.1:0")
+}
+
+// Listen serves on the given network address.
+func Listen(network, address string) (*Server, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:       ln,
+		handlers: make(map[int32]Handler),
+		delays:   make(map[int32]time.Duration),
+		counts:   make(map[int32]int),
+		conns:    make(map[net.Conn]*sync.Mutex),
+	}
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the endpoint to pass as golang_sidecar_endpoint.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Port returns the port the server listens on, zero if it is not a tcp listener.
+func (s *Server) Port() int32 {
+	if addr, ok := s.ln.Addr().(*net.TCPAddr); ok {
+		return int32(addr.Port)
+	}
+	return 0
+}
+
+// Handle registers the handler of uri, requests without handler are answered with an empty success reply.
+func (s *Server) Handle(uri int32, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[uri] = h
+}
+
+// SetDelay holds the replies of uri back for d.
+func (s *Server) SetDelay(uri int32, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delays[uri] = d
+}
+
+// SetRefuse makes the server close every new connection right after accepting it.
+func (s *Server) SetRefuse(refuse bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refuse = refuse
+}
+
+// Count returns how many requests of uri were received.
+func (s *Server) Count(uri int32) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[uri]
+}
+
+// Emit pushes an event to every connected client.
+func (s *Server) Emit(uri int32, message []byte) error {
+	return s.EmitTo(0, uri, message)
+}
+
+// EmitTo pushes an event tagged with the ConnIndex of one client of a shared sidecar.
+func (s *Server) EmitTo(index uint64, uri int32, message []byte) error {
+	h := &rtm2_sdk.Header{Uri: uri, ConnIndex: index, Message: message}
+	s.mu.Lock()
+	conns := make(map[net.Conn]*sync.Mutex, len(s.conns))
+	for conn, wmu := range s.conns {
+		conns[conn] = wmu
+	}
+	s.mu.Unlock()
+	for conn, wmu := range conns {
+		if err := write(conn, wmu, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Disconnect drops every connected client, the server keeps accepting new connections.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	err := s.ln.Close()
+	s.Disconnect()
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.refuse || s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		wmu := &sync.Mutex{}
+		s.conns[conn] = wmu
+		s.mu.Unlock()
+		go s.serve(conn, wmu)
+	}
+}
+
+func (s *Server) serve(conn net.Conn, wmu *sync.Mutex) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		h, err := read(reader)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.counts[h.Uri]++
+		handler := s.handlers[h.Uri]
+		delay := s.delays[h.Uri]
+		s.mu.Unlock()
+
+		resp := &rtm2_sdk.Header{SeqId: h.SeqId, Uri: h.Uri, ConnIndex: h.ConnIndex}
+		if handler != nil {
+			resp.Message, resp.ErrCode, err = handler(h.Uri, h.Message)
+			if err != nil {
+				continue
+			}
+		}
+		if delay > 0 {
+			time.AfterFunc(delay, func() { _ = write(conn, wmu, resp) })
+		} else if err = write(conn, wmu, resp); err != nil {
+			return
+		}
+	}
+}
+
+func read(reader *bufio.Reader) (*rtm2_sdk.Header, error) {
+	prefix, err := reader.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[1]&0x80 != 0 {
+		if prefix, err = reader.Peek(3); err != nil {
+			return nil, err
+		}
+	}
+	length, lenSize, err := rtm2_sdk.DecodeFrameLen(prefix)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, length)
+	if _, err = io.ReadFull(reader, frame); err != nil {
+		return nil, err
+	}
+	_, _, content, err := rtm2_sdk.DecodeFrame(frame, lenSize)
+	if err != nil {
+		return nil, err
+	}
+	h := &rtm2_sdk.Header{}
+	return h, h.Unmarshal(content)
+}
+
+func write(conn net.Conn, wmu *sync.Mutex, h *rtm2_sdk.Header) error {
+	size := h.Size()
+	buffer := make([]byte, rtm2_sdk.FrameSize(size))
+	if err := rtm2_sdk.EncodeFrame(buffer, serviceId, rtm2_sdk.UriCommonResp, h, size); err != nil {
+		return err
+	}
+	wmu.Lock()
+	defer wmu.Unlock()
+	_, err := conn.Write(buffer)
+	return err
+}
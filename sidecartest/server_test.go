@@ -0,0 +1,80 @@
+package sidecartest_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/tomasliu-agora/rtm2"
+	base "github.com/tomasliu-agora/rtm2-base"
+	rtm2_sdk "github.com/tomasliu-agora/rtm2-sdk"
+	"github.com/tomasliu-agora/rtm2-sdk/sidecartest"
+	"go.uber.org/zap"
+)
+
+func TestRoundTripThroughTheSDK(t *testing.T) {
+	srv, err := sidecartest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Handle(rtm2_sdk.UriPresenceWhoNow, func(uri int32, message []byte) ([]byte, int32, error) {
+		req := &base.PresenceWhoNowReq{}
+		if err := req.Unmarshal(message); err != nil {
+			return nil, 0, err
+		}
+		body, err := (&base.PresenceWhoNowResp{Users: []*base.UserState{{UserId: "peer"}}}).Marshal()
+		return body, 0, err
+	})
+	srv.Handle(rtm2_sdk.UriMessagePublish, func(uri int32, message []byte) ([]byte, int32, error) {
+		return nil, 10011, nil // ERR_NOT_LOGIN
+	})
+
+	client := rtm2_sdk.CreateRTM2Client(context.Background(), rtm2.RTMConfig{Appid: "app", UserId: "user", Logger: zap.NewNop()}, make(chan error, 10))
+	client.SetParameters(map[string]interface{}{"golang_sidecar_endpoint": srv.Addr()})
+	if _, _, err := client.Login("token"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	defer client.Logout()
+
+	users, _, err := client.Presence().WhoNow("channel", rtm2.ChannelTypeStream)
+	if err != nil {
+		t.Fatalf("who now: %v", err)
+	}
+	if _, ok := users["peer"]; !ok || len(users) != 1 {
+		t.Fatalf("got users %v, want peer", users)
+	}
+	if err = client.Publish("channel", []byte("hello")); !errors.Is(err, rtm2.ERR_NOT_LOGIN) {
+		t.Fatalf("publish: got %v, want ERR_NOT_LOGIN", err)
+	}
+	for uri, want := range map[int32]int{rtm2_sdk.UriLogin: 1, rtm2_sdk.UriPresenceWhoNow: 1, rtm2_sdk.UriMessagePublish: 1} {
+		if got := srv.Count(uri); got != want {
+			t.Fatalf("uri %d received %d times, want %d", uri, got, want)
+		}
+	}
+}
+
+func TestRoundTripOverUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rtm2.sock")
+	srv, err := sidecartest.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	client := rtm2_sdk.CreateRTM2Client(context.Background(), rtm2.RTMConfig{Appid: "app", UserId: "user", Logger: zap.NewNop()}, make(chan error, 10))
+	client.SetParameters(map[string]interface{}{"golang_sidecar_endpoint": "unix://" + path})
+	if _, _, err := client.Login("token"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	defer client.Logout()
+	if _, _, err := client.Presence().WhoNow("channel", rtm2.ChannelTypeStream); err != nil {
+		t.Fatalf("who now: %v", err)
+	}
+	for uri, want := range map[int32]int{rtm2_sdk.UriLogin: 1, rtm2_sdk.UriPresenceWhoNow: 1} {
+		if got := srv.Count(uri); got != want {
+			t.Fatalf("uri %d received %d times, want %d", uri, got, want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package rtm2_sdk
+
+import "sync/atomic"
+
+// Stats is a snapshot of the SDK internals of a client.
+type Stats struct {
+	Connection ConnectionStats
+	Sidecar    SidecarStats // zero when the client uses golang_sidecar_endpoint
+}
+
+// ConnectionStats is a snapshot of the counters of a connection to the sidecar.
+type ConnectionStats struct {
+	Links       int   // connections to the sidecar, counters are summed over them
+	Pending     int   // requests waiting for a reply
+	Canceled    int64 // requests given up by their waiter, on timeout or context cancellation
+	Expired     int64 // requests removed by the sweeper after their deadline
+	LateReplies int64 // replies arriving for a request no longer pending
+	Duplicates  int64 // copies of an event discarded because another link delivered it
+
+	QueueDepth    int   // requests queued but not written yet
+	QueueCapacity int   // size of the outgoing queues, golang_queue_size for each lane
+	QueueRejected int64 // requests refused because the queue was full
+	QueueDropped  int64 // queued requests evicted by QueueDropOldest
+
+	Events EventStats
+}
+
+// EventQueueStats is a snapshot of the counters of event queues.
+type EventQueueStats struct {
+	Dispatched int64 // events handed to the client
+	Dropped    int64 // events discarded because their queue was full
+	Failed     int64 // events the client failed to decode or handle
+	QueueDepth int   // events waiting to be handed to the client
+}
+
+// EventStats sums the event queues, ByUri details them by event uri.
+type EventStats struct {
+	EventQueueStats
+	ByUri map[int32]EventQueueStats
+}
+
+func (s *EventQueueStats) add(o EventQueueStats) {
+	s.Dispatched += o.Dispatched
+	s.Dropped += o.Dropped
+	s.Failed += o.Failed
+	s.QueueDepth += o.QueueDepth
+}
+
+type connectionStats struct {
+	canceled    int64
+	expired     int64
+	lateReplies int64
+	duplicates  int64
+	rejected    int64
+	dropped     int64
+}
+
+func (c *connection) Stats() ConnectionStats {
+	return ConnectionStats{
+		Pending:     c.requests.len(),
+		Canceled:    atomic.LoadInt64(&c.stats.canceled),
+		Expired:     atomic.LoadInt64(&c.stats.expired),
+		LateReplies: atomic.LoadInt64(&c.stats.lateReplies),
+		Duplicates:  atomic.LoadInt64(&c.stats.duplicates),
+
+		QueueDepth:    c.lanes.len(),
+		QueueCapacity: c.lanes.cap(),
+		QueueRejected: atomic.LoadInt64(&c.stats.rejected),
+		QueueDropped:  atomic.LoadInt64(&c.stats.dropped),
+
+		Events: c.events.Stats(),
+	}
+}
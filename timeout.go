@@ -0,0 +1,49 @@
+package rtm2_sdk
+
+import "time"
+
+const defaultRequestTimeout = time.Second * 5
+
+// defaultUriTimeouts lists operations known to take longer than a plain round trip,
+// they are used unless the overall timeout is already longer.
+var defaultUriTimeouts = map[int32]time.Duration{
+	UriLogin:       time.Second * 15,
+	UriLockAcquire: time.Second * 30,
+}
+
+type requestTimeouts struct {
+	timeout time.Duration
+	uris    map[int32]time.Duration
+}
+
+func newRequestTimeouts() *requestTimeouts {
+	return &requestTimeouts{timeout: defaultRequestTimeout, uris: make(map[int32]time.Duration)}
+}
+
+// apply reads kParamRequestTimeout and the per uri overrides of kParamRequestTimeouts.
+func (t *requestTimeouts) apply(params map[string]interface{}) {
+	if timeout := paramMillis(params, kParamRequestTimeout, t.timeout); timeout > 0 {
+		t.timeout = timeout
+	}
+	if value, ok := params[kParamRequestTimeouts]; ok {
+		if uris, ok := value.(map[int32]int32); ok {
+			for uri, ms := range uris {
+				if ms > 0 {
+					t.uris[uri] = time.Duration(ms) * time.Millisecond
+				} else {
+					delete(t.uris, uri)
+				}
+			}
+		}
+	}
+}
+
+func (t *requestTimeouts) of(uri int32) time.Duration {
+	if timeout, ok := t.uris[uri]; ok {
+		return timeout
+	}
+	if timeout, ok := defaultUriTimeouts[uri]; ok && timeout > t.timeout {
+		return timeout
+	}
+	return t.timeout
+}
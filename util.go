@@ -1,6 +1,57 @@
 package rtm2_sdk
 
-import base "github.com/tomasliu-agora/rtm2-base"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	unixScheme = "unix://"
+	tcpScheme  = "tcp://"
+)
+
+// splitEndpoint turns an endpoint into a network and an address, "unix:///path/to/sock" for unix sockets,
+// "host:port" or "tcp://host:port" for tcp.
+func splitEndpoint(edp string) (string, string) {
+	if strings.HasPrefix(edp, unixScheme) {
+		return "unix", strings.TrimPrefix(edp, unixScheme)
+	}
+	return "tcp", strings.TrimPrefix(edp, tcpScheme)
+}
+
+func paramInt32(params map[string]interface{}, key string, def int32) int32 {
+	if value, ok := params[key]; ok {
+		switch v := value.(type) {
+		case int32:
+			return v
+		case int:
+			return int32(v)
+		case int64:
+			return int32(v)
+		case float64:
+			return int32(v)
+		}
+	}
+	return def
+}
+
+func paramFloat64(params map[string]interface{}, key string, def float64) float64 {
+	if value, ok := params[key]; ok {
+		switch v := value.(type) {
+		case float64:
+			return v
+		case float32:
+			return float64(v)
+		}
+	}
+	return def
+}
+
+// paramMillis reads a duration given in milliseconds.
+func paramMillis(params map[string]interface{}, key string, def time.Duration) time.Duration {
+	return time.Duration(paramInt32(params, key, int32(def/time.Millisecond))) * time.Millisecond
+}
 
 func generateHeader(uri int32, m Marshalable) *Header {
 	buffer, _ := m.Marshal()
@@ -8,136 +59,24 @@ func generateHeader(uri int32, m Marshalable) *Header {
 }
 
 func getUriFromReq(req interface{}) int32 {
-	switch req.(type) {
-	case *base.LoginReq:
-		return UriLogin
-	case *base.LogoutReq:
-		return UriLogout
-	case *base.MessageSubReq:
-		return UriMessageSubscribe
-	case *base.MessageUnsubReq:
-		return UriMessageUnsubscribe
-	case *base.MessagePublishReq:
-		return UriMessagePublish
-	case *base.StreamJoinReq:
-		return UriStreamJoin
-	case *base.StreamLeaveReq:
-		return UriStreamLeave
-	case *base.StreamJoinTopicReq:
-		return UriStreamJoinTopic
-	case *base.StreamMessageReq:
-		return UriStreamPublish
-	case *base.StreamLeaveTopicReq:
-		return UriStreamLeaveTopic
-	case *base.StreamSubTopicReq:
-		return UriStreamSubTopic
-	case *base.StreamUnsubTopicReq:
-		return UriStreamUnsubTopic
-	case *base.StreamSubListReq:
-		return 0 // TODO
-	case *base.StorageChannelReq:
-		return UriStorageOpChannelMetaData
-	case *base.StorageChannelGetReq:
-		return UriStorageGetChannelMetaData
-	case *base.StorageUserReq:
-		return UriStorageOpUserMetaData
-	case *base.StorageUserGetReq:
-		return UriStorageGetUserMetaData
-	case *base.StorageUserSubReq:
-		return UriStorageSubscribeUserMetaData
-	case *base.StorageUserUnsubReq:
-		return UriStorageUnSubscribeUserMetaData
-	case *base.PresenceWhereNowReq:
-		return UriPresenceWhereNow
-	case *base.PresenceWhoNowReq:
-		return UriPresenceWhoNow
-	case *base.PresenceSetStateReq:
-		return UriPresenceSetState
-	case *base.PresenceGetStateReq:
-		return UriPresenceGetState
-	case *base.PresenceRemoveStateReq:
-		return UriPresenceRemoveState
-	case *base.SetParamsReq:
-		return UriSetParam
-	case *base.RenewTokenReq:
-		return UriRenewToken
-	case *base.LockSetReq:
-		return UriLockSet
-	case *base.LockRemoveReq:
-		return UriLockRemove
-	case *base.LockGetReq:
-		return UriLockGet
-	case *base.LockAcquireReq:
-		return UriLockAcquire
-	case *base.LockReleaseReq:
-		return UriLockRelease
-	case *base.LockRevokeReq:
-		return UriLockRevoke
-	case base.TokenPrivilegeExpire:
-		return UriTokenPrivilegeExpire
-	default:
-		return 0
-	}
+	return registry.uriOf(req)
 }
 
+// unmarshalResp decodes the body of a reply into the response registered for uri, or into a *RawResponse
+// when there is none. It returns a nil response only for a reply without body nor registered response.
 func unmarshalResp(uri int32, errCode int32, message []byte) (interface{}, int32, error) {
-	switch uri {
-	case UriStreamSubTopic:
-		resp := &base.StreamSubTopicResp{}
-		err := resp.Unmarshal(message)
-		if err != nil {
-			return nil, errCode, err
-		} else {
-			return resp, errCode, nil
-		}
-	case UriStorageGetChannelMetaData:
-		resp := &base.StorageChannelGetResp{}
-		err := resp.Unmarshal(message)
-		if err != nil {
-			return nil, errCode, err
-		} else {
-			return resp, errCode, nil
-		}
-	case UriStorageGetUserMetaData:
-		resp := &base.StorageUserGetResp{}
-		err := resp.Unmarshal(message)
-		if err != nil {
-			return nil, errCode, err
-		} else {
-			return resp, errCode, nil
-		}
-	case UriPresenceWhoNow:
-		resp := &base.PresenceWhoNowResp{}
-		err := resp.Unmarshal(message)
-		if err != nil {
-			return nil, errCode, err
-		} else {
-			return resp, errCode, nil
-		}
-	case UriPresenceWhereNow:
-		resp := &base.PresenceWhereNowResp{}
-		err := resp.Unmarshal(message)
-		if err != nil {
-			return nil, errCode, err
-		} else {
-			return resp, errCode, nil
-		}
-	case UriPresenceGetState:
-		resp := &base.PresenceGetStateResp{}
-		err := resp.Unmarshal(message)
-		if err != nil {
-			return nil, errCode, err
-		} else {
-			return resp, errCode, nil
-		}
-	case UriLockGet:
-		resp := &base.LockGetResp{}
-		err := resp.Unmarshal(message)
-		if err != nil {
-			return nil, errCode, err
-		} else {
-			return resp, errCode, nil
+	op := registry.operation(uri)
+	if op == nil || op.newResp == nil {
+		if len(message) == 0 {
+			return nil, errCode, nil
 		}
+		// a body the SDK does not know yet, it is kept for the caller rather than dropped
+		return &RawResponse{Uri: uri, ErrCode: errCode, Message: message}, errCode, nil
+	}
+	// an empty body is an empty response, callers of a uri with a response expect one
+	resp := op.newResp()
+	if err := resp.Unmarshal(message); err != nil {
+		return nil, errCode, fmt.Errorf("decode reply of uri %d: %w", uri, err)
 	}
-	return nil, 0, nil
+	return resp, errCode, nil
 }